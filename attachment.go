@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/logger"
+	"github.com/section77/matterbot/mail"
+)
+
+// attachments contains the files of a chat message - as mail attachments,
+// or as links if they exceed the size limit (see '-mail-attachment-limit')
+type attachments struct {
+	files []mail.Attachment
+	links []chat.File
+}
+
+// loadAttachments downloads the files of the message in the order of the
+// message, as long as the total size is below the limit. files above the
+// limit, or which can't be downloaded, are linked.
+//
+// the file infos are looked up here - only for messages which are forwarded.
+func loadAttachments(chatServer chat.Server, msg *chat.Message) *attachments {
+	a := &attachments{}
+	if len(msg.FileIDs) == 0 {
+		return a
+	}
+
+	files := chatServer.Files(msg)
+	var total int64
+	for i := range files {
+		f := &files[i]
+		if total+f.Size > int64(*mailAttachmentLimit) {
+			logger.Infof("file: '%s' (%d bytes) exceeds the attachment limit - send a link", f.Name, f.Size)
+			a.links = append(a.links, *f)
+			continue
+		}
+
+		data, err := chatServer.FileContent(f)
+		if err != nil {
+			logger.Errorf("unable to download file: '%s' - send a link - error: %s", f.Name, err.Error())
+			a.links = append(a.links, *f)
+			continue
+		}
+
+		total += int64(len(data))
+		a.files = append(a.files, mail.Attachment{Name: f.Name, ContentType: f.MimeType, Data: data})
+	}
+	return a
+}
+
+// linkList returns the links to the files which are not attached - to append them to the mail body
+func (a *attachments) linkList() string {
+	if len(a.links) == 0 {
+		return ""
+	}
+
+	xs := []string{"", "", "Files:"}
+	for _, f := range a.links {
+		xs = append(xs, fmt.Sprintf("  - %s (%s): %s", f.Name, formatSize(f.Size), f.Link))
+	}
+	return strings.Join(xs, "\n")
+}
+
+// linkListHTML returns the links to the files which are not attached - to append them to the html body
+func (a *attachments) linkListHTML() string {
+	if len(a.links) == 0 {
+		return ""
+	}
+
+	xs := []string{"<p>Files:</p>", "<ul>"}
+	for _, f := range a.links {
+		xs = append(xs, fmt.Sprintf(`<li><a href="%s">%s</a> (%s)</li>`,
+			html.EscapeString(f.Link), html.EscapeString(f.Name), formatSize(f.Size)))
+	}
+	xs = append(xs, "</ul>")
+	return strings.Join(xs, "\n")
+}
+
+// formatSize formats the size in bytes human readable - like: '1.5 MB'
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
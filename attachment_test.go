@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/mail"
+)
+
+// files below the limit should be attached, other files should be linked
+func TestDispatchForwardsFiles(t *testing.T) {
+	origLimit := *mailAttachmentLimit
+	defer func() { *mailAttachmentLimit = origLimit }()
+	*mailAttachmentLimit = 10
+
+	chatMock := chat.NewMock()
+	chatMock.FileContents = map[string][]byte{
+		"small": []byte("small"),
+		"big":   []byte("big file content"),
+	}
+	mailMock := mail.NewMock()
+
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+	))
+
+	chatMock.FileInfos = map[string]chat.File{
+		"small":   chat.File{ID: "small", Name: "small.txt", MimeType: "text/plain", Size: 5, Link: "https://chat/files/small"},
+		"big":     chat.File{ID: "big", Name: "big.txt", MimeType: "text/plain", Size: 16, Link: "https://chat/files/big"},
+		"missing": chat.File{ID: "missing", Name: "missing.txt", MimeType: "text/plain", Size: 1, Link: "https://chat/files/missing"},
+	}
+
+	chatMock.TriggerMsgEvent(chat.Message{
+		Content: "@ml see the files",
+		FileIDs: []string{"small", "big", "missing"},
+	})
+
+	if len(mailMock.Messages()) != 1 {
+		t.Fatalf("expected one mail - found: %d", len(mailMock.Messages()))
+	}
+
+	body := mailMock.Messages()[0].Body
+	for _, expected := range []string{
+		"multipart/mixed",
+		"filename=small.txt",
+		"  - big.txt (16 B): https://chat/files/big",
+		"  - missing.txt (1 B): https://chat/files/missing",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("'%s' not found in mail: %s", expected, body)
+		}
+	}
+	if strings.Contains(body, "filename=big.txt") {
+		t.Errorf("file above the limit is attached")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		0:                 "0 B",
+		1023:              "1023 B",
+		1536:              "1.5 KB",
+		10 << 20:          "10.0 MB",
+		3 * (1 << 30) / 2: "1.5 GB",
+	}
+	for size, expected := range tests {
+		if s := formatSize(size); s != expected {
+			t.Errorf("size: %d - expected: %s, found: %s", size, expected, s)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// a connection which lasts at least this duration resets the reconnect backoff
+var stableConnectionDuration = 1 * time.Minute
+
+// reconnectBackoff calculates the delays between reconnect attempts.
+//
+// the delay doubles after each failed attempt (capped at 'maxDelay'), and
+// has a random jitter - so many clients don't reconnect at the same time.
+type reconnectBackoff struct {
+	minDelay time.Duration
+	maxDelay time.Duration
+
+	// failed attempts since the last stable connection
+	attempts int
+	// time of the first failed attempt since the last stable connection
+	downSince time.Time
+
+	// to control the jitter in unit-tests
+	random func() float64
+}
+
+func newReconnectBackoff(minDelay, maxDelay time.Duration) *reconnectBackoff {
+	return &reconnectBackoff{
+		minDelay: minDelay,
+		maxDelay: maxDelay,
+		random:   rand.Float64,
+	}
+}
+
+// next records a failed attempt and returns the delay before the next attempt.
+//
+// the delay is between the half and the full exponential delay.
+func (b *reconnectBackoff) next() time.Duration {
+	if b.attempts == 0 {
+		b.downSince = time.Now()
+	}
+	b.attempts = b.attempts + 1
+
+	delay := b.minDelay
+	for i := 1; i < b.attempts && delay < b.maxDelay; i++ {
+		delay = delay * 2
+	}
+	if delay > b.maxDelay {
+		delay = b.maxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(b.random()*float64(delay-half))
+}
+
+// reset is called after a stable connection
+func (b *reconnectBackoff) reset() {
+	b.attempts = 0
+	b.downSince = time.Time{}
+}
+
+// exhausted returns 'true' if the max. number of attempts or the max. downtime
+// is reached - a zero value disables the limit
+func (b *reconnectBackoff) exhausted(maxAttempts int, maxDowntime time.Duration) bool {
+	if maxAttempts > 0 && b.attempts >= maxAttempts {
+		return true
+	}
+	return maxDowntime > 0 && b.attempts > 0 && time.Since(b.downSince) >= maxDowntime
+}
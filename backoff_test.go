@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoffIsCappedAndJittered(t *testing.T) {
+	b := newReconnectBackoff(1*time.Second, 10*time.Second)
+
+	// 'random' returns the max. jitter
+	b.random = func() float64 { return 1 }
+	for i, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if delay := b.next(); delay != expected*time.Second {
+			t.Errorf("%d. attempt: expected delay: %s, received: %s", i+1, expected*time.Second, delay)
+		}
+	}
+
+	// 'random' returns the min. jitter
+	b.reset()
+	b.random = func() float64 { return 0 }
+	for i, expected := range []time.Duration{500 * time.Millisecond, 1 * time.Second, 2 * time.Second} {
+		if delay := b.next(); delay != expected {
+			t.Errorf("%d. attempt after reset: expected delay: %s, received: %s", i+1, expected, delay)
+		}
+	}
+}
+
+func TestReconnectBackoffExhausted(t *testing.T) {
+	b := newReconnectBackoff(time.Second, time.Minute)
+
+	if b.exhausted(3, time.Hour) {
+		t.Errorf("backoff without failed attempts should not be exhausted")
+	}
+
+	b.next()
+	b.next()
+	if b.exhausted(3, time.Hour) || b.exhausted(0, 0) {
+		t.Errorf("backoff after 2 attempts should not be exhausted")
+	}
+
+	b.next()
+	if !b.exhausted(3, 0) {
+		t.Errorf("backoff after 3 attempts should be exhausted with max. attempts: 3")
+	}
+
+	b.downSince = time.Now().Add(-2 * time.Hour)
+	if !b.exhausted(0, time.Hour) {
+		t.Errorf("backoff should be exhausted after the max. downtime")
+	}
+
+	b.reset()
+	if b.exhausted(3, time.Hour) {
+		t.Errorf("backoff should not be exhausted after a reset")
+	}
+}
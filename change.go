@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/logger"
+	"github.com/section77/matterbot/mail"
+)
+
+// forwardChange forwards an edited message as a correction, and a deleted
+// message as a retraction notice - to each recipient of the original message.
+//
+//   - only messages which are remembered as forwarded (see '-dedup-file') are handled
+//   - the corrections / retractions can be disabled per forward rule
+//   - if a rule still matches the new content, the matched text is stripped
+//     like in the original message
+//   - a correction is sent once per text edit - updates without a new edit-timestamp
+//     (like pin / unpin) are ignored
+func forwardChange(chatServer chat.Server, mailServer mail.Server, fc *forwardConfig, msg chat.Message) {
+	if forwarded == nil {
+		logger.Debugf("ignore %s message - forwarded messages are not remembered", msg.Event)
+		return
+	}
+
+	if msg.Event == chat.Edited && msg.EditAt == 0 {
+		logger.Debugf("ignore edited message from: %s - the text is unchanged", msg.UserName)
+		return
+	}
+
+	contents := map[string]string{}
+	for _, x := range fc.match(msg.Content) {
+		if _, found := contents[x.mailAddr]; !found {
+			contents[x.mailAddr] = x.content
+		}
+	}
+
+	// each recipient gets only one mail - even if it's in many rules
+	groups := fwdGroups{}
+	for _, m := range fc.fwdMappings {
+		if !forwarded.Seen(msg.ID, m.mailAddr) {
+			continue
+		}
+
+		if msg.Event == chat.Edited && forwarded.Seen(forwardedID(&msg), m.mailAddr) {
+			logger.Debugf("ignore edited message for: %s - the edit is already forwarded", m.mailAddr)
+			continue
+		}
+
+		if !m.followsChanges(msg.Event) {
+			logger.Infof("ignore %s message for rule: '%s' - disabled", msg.Event, m.label())
+			continue
+		}
+
+		content, found := contents[m.mailAddr]
+		if !found {
+			content = msg.Content
+		}
+
+		logger.Infof("forward %s message from: %s to %s", msg.Event, msg.UserName, m.mailAddr)
+		groups.add(fwdMatch{m, content})
+	}
+
+	for _, g := range groups {
+		sendMail(chatServer, mailServer, &msg, composeMessage(&msg, g.content, g.mappings, fc, nil))
+	}
+}
+
+// followsChanges returns 'true' if corrections / retractions are
+// enabled for the mapping
+func (m fwdMapping) followsChanges(event chat.Event) bool {
+	if m.opts == nil {
+		return true
+	}
+
+	switch event {
+	case chat.Edited:
+		return !m.opts.noCorrections
+	case chat.Deleted:
+		return !m.opts.noRetractions
+	}
+	return true
+}
+
+// threadHeader sets the 'Message-ID' of the mail. the mails for edited and
+// deleted messages refers to the mail of the original message. replies in a
+// thread refers to the mail of the thread root - if it was forwarded to the
+// same recipient.
+//
+// the message ids are derived from the post id - so no state is needed
+// to refer the original mail.
+func threadHeader(header *mail.Header, msg *chat.Message) {
+	original := messageID(msg.ID)
+
+	references := []string{}
+	if msg.RootID != "" && forwarded != nil {
+		for _, rcpt := range header.Recipients() {
+			if forwarded.Seen(msg.RootID, rcpt) {
+				references = append(references, messageID(msg.RootID))
+				break
+			}
+		}
+	}
+
+	switch msg.Event {
+	case chat.Posted:
+		header.MessageID = original
+	case chat.Edited:
+		header.MessageID = messageID(fmt.Sprintf("%s.correction.%d", msg.ID, msg.EditAt))
+		references = append(references, original)
+	case chat.Deleted:
+		header.MessageID = messageID(msg.ID + ".retraction")
+		references = append(references, original)
+	}
+
+	if len(references) > 0 {
+		header.InReplyTo = references[len(references)-1]
+		header.References = strings.Join(references, " ")
+	}
+}
+
+// messageID returns the mail message id for the given id - like: '<id@domain>'
+func messageID(id string) string {
+	return "<" + id + "@" + messageIDDomain() + ">"
+}
+
+// messageIDDomain returns the domain of the mail user - 'matterbot' if
+// the mail user has no domain
+func messageIDDomain() string {
+	if _, domain, ok := splitAddress(*mailUser); ok {
+		return domain
+	}
+	return "matterbot"
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/dedup"
+	"github.com/section77/matterbot/mail"
+)
+
+// edited and deleted messages should be forwarded as corrections and
+// retractions - threaded to the original mail
+func TestDispatchForwardsChanges(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	dir, err := ioutil.TempDir("", "matterbot-changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if forwarded, err = dedup.New(filepath.Join(dir, "dedup.json"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := startDispatch(chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+		fwdMapping{marker: "ml", mailAddr: "archive@mail.com", opts: &fwdOptions{noRetractions: true}},
+	))
+	// stop the dispatcher before the dedup store is disabled
+	defer func() {
+		stop()
+		forwarded = nil
+	}()
+
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", UserName: "user", Content: "@ml meeting at 3"})
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", UserName: "user", Content: "@ml meeting at 4", EditAt: 200, Event: chat.Edited})
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", UserName: "user", Content: "@ml meeting at 4", Event: chat.Deleted})
+
+	// not forwarded before
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-2", UserName: "user", Content: "@ml new marker", EditAt: 200, Event: chat.Edited})
+
+	if len(mailMock.Messages()) != 5 {
+		t.Fatalf("expected 5 mails - found: %d", len(mailMock.Messages()))
+	}
+
+	original := mailMock.Messages()[0]
+	if original.Header.MessageID != "<post-1@localhost>" {
+		t.Errorf("unexpected message id: %s", original.Header.MessageID)
+	}
+
+	tests := []struct {
+		msg     *mail.Message
+		to      string
+		subject string
+		content string
+	}{
+		{mailMock.Messages()[2], "ml@mail.com", "[correction] ", "meeting at 4"},
+		{mailMock.Messages()[3], "archive@mail.com", "[correction] ", "meeting at 4"},
+		{mailMock.Messages()[4], "ml@mail.com", "[retracted] ", "user has deleted the message"},
+	}
+	for _, test := range tests {
+		h := test.msg.Header
+		if h.To.String() != test.to || !strings.HasPrefix(h.Subject, test.subject) || !strings.Contains(test.msg.Body, test.content) {
+			t.Errorf("unexpected mail: %+v", test.msg)
+		}
+		if h.InReplyTo != original.Header.MessageID || h.References != original.Header.MessageID {
+			t.Errorf("mail: '%s' isn't threaded to the original: %+v", h.Subject, h)
+		}
+		if h.MessageID == original.Header.MessageID {
+			t.Errorf("mail: '%s' needs its own message id", h.Subject)
+		}
+		if !strings.Contains(test.msg.Body, "In-Reply-To: <post-1@localhost>\r\n") {
+			t.Errorf("mail: '%s' without 'In-Reply-To' header: %s", h.Subject, test.msg.Body)
+		}
+	}
+}
+
+// an update without a text edit (like pin / unpin) should not send a correction,
+// and each edit should be forwarded only once
+func TestDispatchIgnoresUpdatesWithoutEdit(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	dir, err := ioutil.TempDir("", "matterbot-changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if forwarded, err = dedup.New(filepath.Join(dir, "dedup.json"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := startDispatch(chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+	))
+	defer func() {
+		stop()
+		forwarded = nil
+	}()
+
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", UserName: "user", Content: "@ml meeting at 3"})
+	// pinned
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", UserName: "user", Content: "@ml meeting at 3", Event: chat.Edited})
+	if len(mailMock.Messages()) != 1 {
+		t.Fatalf("expected no correction for the pinned message - found: %d mails", len(mailMock.Messages()))
+	}
+
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", UserName: "user", Content: "@ml meeting at 4", EditAt: 200, Event: chat.Edited})
+	// unpinned - the edit-timestamp is unchanged
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", UserName: "user", Content: "@ml meeting at 4", EditAt: 200, Event: chat.Edited})
+	if len(mailMock.Messages()) != 2 {
+		t.Fatalf("expected one correction - found: %d mails", len(mailMock.Messages()))
+	}
+	if h := mailMock.Messages()[1].Header; h.MessageID != "<post-1.correction.200@localhost>" {
+		t.Errorf("unexpected message id of the correction: %s", h.MessageID)
+	}
+}
+
+// replies in a thread should refer to the mail of the thread root - if it was
+// forwarded to the same recipient
+func TestDispatchThreadsReplies(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	dir, err := ioutil.TempDir("", "matterbot-threads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if forwarded, err = dedup.New(filepath.Join(dir, "dedup.json"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := startDispatch(chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+		fwdMapping{marker: "other", mailAddr: "other@mail.com"},
+	))
+	defer func() {
+		stop()
+		forwarded = nil
+	}()
+
+	chatMock.TriggerMsgEvent(chat.Message{ID: "root", UserName: "user", Content: "@ml meeting at 3"})
+	chatMock.TriggerMsgEvent(chat.Message{ID: "reply-1", RootID: "root", UserName: "user", Content: "@ml @other at 4"})
+	chatMock.TriggerMsgEvent(chat.Message{ID: "reply-1", RootID: "root", UserName: "user", Content: "@ml at 5", EditAt: 200, Event: chat.Edited})
+
+	if len(mailMock.Messages()) != 5 {
+		t.Fatalf("expected 5 mails - found: %d", len(mailMock.Messages()))
+	}
+
+	tests := []struct {
+		msg        *mail.Message
+		messageID  string
+		inReplyTo  string
+		references string
+	}{
+		{mailMock.Messages()[0], "<root@localhost>", "", ""},
+		{mailMock.Messages()[1], "<reply-1@localhost>", "<root@localhost>", "<root@localhost>"},
+		// the root wasn't forwarded to this recipient
+		{mailMock.Messages()[2], "<reply-1@localhost>", "", ""},
+		{mailMock.Messages()[3], "", "<reply-1@localhost>", "<root@localhost> <reply-1@localhost>"},
+		{mailMock.Messages()[4], "", "<reply-1@localhost>", "<reply-1@localhost>"},
+	}
+	for i, test := range tests {
+		h := test.msg.Header
+		if (test.messageID != "" && h.MessageID != test.messageID) || h.InReplyTo != test.inReplyTo || h.References != test.references {
+			t.Errorf("mail: %d to: %s - unexpected thread header: %+v", i, h.To, h)
+		}
+	}
+}
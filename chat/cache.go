@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaults for the lookup caches in the mattermost adapter
+const (
+	cacheCapacity = 1000
+	cacheTTL      = 10 * time.Minute
+)
+
+// CacheStats contains the hit and miss counts of a cache
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// cache is a LRU cache where each entry expires after the ttl
+type cache struct {
+	capacity int
+	ttl      time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// recently used entries are in the front
+	order *list.List
+
+	hits   uint64
+	misses uint64
+
+	// to control the time in unit-tests
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newCache(capacity int, ttl time.Duration) *cache {
+	return &cache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// get returns the cached value - 'false' if it's not cached or expired
+func (c *cache) get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		entry := elem.Value.(*cacheEntry)
+		if c.now().Before(entry.expires) {
+			c.order.MoveToFront(elem)
+			atomic.AddUint64(&c.hits, 1)
+			return entry.value, true
+		}
+		c.removeElement(elem)
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+// put caches the value - the least recently used entry is
+// removed if the cache is full
+func (c *cache) put(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		c.removeElement(elem)
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, value, c.now().Add(c.ttl)})
+	if c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// removeFunc removes all entries where the given function returns 'true'
+func (c *cache) removeFunc(f func(key string, value interface{}) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, elem := range c.entries {
+		if entry := elem.Value.(*cacheEntry); f(entry.key, entry.value) {
+			c.removeElement(elem)
+		}
+	}
+}
+
+func (c *cache) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (c *cache) stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCache(2, time.Hour)
+	c.put("a", 1)
+	c.put("b", 2)
+
+	// 'a' is now recently used - so 'b' should be evicted
+	c.get("a")
+	c.put("c", 3)
+
+	if _, found := c.get("b"); found {
+		t.Errorf("least recently used entry 'b' should be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, found := c.get(key); !found {
+			t.Errorf("entry '%s' should be cached", key)
+		}
+	}
+
+	if stats := c.stats(); stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCacheEntriesExpire(t *testing.T) {
+	c := newCache(10, time.Minute)
+	c.put("a", 1)
+
+	if v, found := c.get("a"); !found || v.(int) != 1 {
+		t.Errorf("entry 'a' should be cached")
+	}
+
+	c.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, found := c.get("a"); found {
+		t.Errorf("entry 'a' should be expired")
+	}
+}
@@ -1,11 +1,26 @@
 // Package chat is the interface to the chat-system
 package chat
 
+import "context"
+
 // Server defines the interface to the chat-system
 type Server interface {
 	IsConnected() bool
 	Send(*Message) error
-	Listen() (<-chan Message, <-chan error, error)
+	Listen(context.Context) (<-chan Message, <-chan error, error)
+	PostsSince(int64) ([]Message, error)
+	ServerTime() (int64, error)
+	Message(id string) (*Message, error)
+	Sender(*Message) (*Sender, error)
+	Files(*Message) []File
+	FileContent(*File) ([]byte, error)
+	Resolver
+}
+
+// Resolver resolves team and channel names to their ids
+type Resolver interface {
+	TeamID(teamName string) (string, error)
+	ChannelID(teamName, channelName string) (string, error)
 }
 
 // Message represents a chat message
@@ -13,8 +28,64 @@ type Message struct {
 	ID          string
 	UserID      string
 	UserName    string
+	TeamID      string
 	ChannelID   string
 	ChannelName string
 	Content     string
 	ReplyToID   string
+	CreateAt    int64
+
+	// ids of the attached files - the infos are looked up per 'Files'
+	FileIDs []string
+
+	// timestamp of the last text edit - pins and other updates don't change it
+	EditAt int64
+
+	// id of the first message of the thread - empty if the message isn't a reply
+	RootID string
+
+	// 'Posted' for new messages, 'Edited' or 'Deleted' for changes
+	Event Event
+}
+
+// Event is the kind of a message event
+type Event int
+
+// message events
+const (
+	Posted Event = iota
+	Edited
+	Deleted
+)
+
+func (e Event) String() string {
+	switch e {
+	case Edited:
+		return "edited"
+	case Deleted:
+		return "deleted"
+	}
+	return "posted"
+}
+
+// File is an attachment of a message
+type File struct {
+	ID       string
+	Name     string
+	MimeType string
+	Size     int64
+
+	// url of the file in the chat-system
+	Link string
+}
+
+// Sender contains the permission related infos about the author of a message
+type Sender struct {
+	UserName string
+
+	// system, team and channel roles - like 'system_admin', 'team_admin', 'channel_admin'
+	Roles []string
+
+	// group names
+	Groups []string
 }
@@ -1,10 +1,15 @@
 package chat
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/mattermost/platform/model"
 	"github.com/section77/matterbot/logger"
@@ -14,6 +19,11 @@ import (
 type Mattermost struct {
 	client *model.Client4
 	userID string
+
+	// lookup caches - the websocket events invalidates the entries
+	users    *cache
+	channels *cache
+	teams    *cache
 }
 
 // Connect to the mattermost server.
@@ -29,10 +39,36 @@ func Connect(url *url.URL, loginID, pass string) (*Mattermost, error) {
 	}
 	logger.Debugf("login success for loginID: %s, user: %+v", loginID, user)
 
+	return newMattermost(client, user.Id), nil
+}
+
+// ConnectWithToken connects to the mattermost server with a personal access
+// token or a bot-account token - no login is necessary.
+// returns a connection handle to interact with the server
+func ConnectWithToken(url *url.URL, token string) (*Mattermost, error) {
+	client := model.NewAPIv4Client(url.String())
+	client.AuthToken = token
+	client.AuthType = model.HEADER_BEARER
+
+	logger.Debug("try to lookup the user for the access token")
+	user, resp := client.GetMe("")
+	if resp.Error != nil {
+		err := fmt.Errorf("invalid access token: %s", detailedErrOrMsg(resp))
+		return nil, err
+	}
+	logger.Debugf("access token valid for user: %+v", user)
+
+	return newMattermost(client, user.Id), nil
+}
+
+func newMattermost(client *model.Client4, userID string) *Mattermost {
 	return &Mattermost{
-		client: client,
-		userID: user.Id,
-	}, nil
+		client:   client,
+		userID:   userID,
+		users:    newCache(cacheCapacity, cacheTTL),
+		channels: newCache(cacheCapacity, cacheTTL),
+		teams:    newCache(cacheCapacity, cacheTTL),
+	}
 }
 
 // IsConnected returns the connection status.
@@ -71,11 +107,13 @@ func (m *Mattermost) Send(msg *Message) error {
 //   * an message channel with incomming chat messages
 //   * an error channel with occurred errors
 //
-func (m *Mattermost) Listen() (<-chan Message, <-chan error, error) {
+// If the context is canceled, the websocket connection is closed.
+//
+func (m *Mattermost) Listen(ctx context.Context) (<-chan Message, <-chan error, error) {
 
 	// url is already validated - so no error checking here
 	url, _ := url.Parse(m.client.Url)
-	wsURL := fmt.Sprintf("ws://%s:%s", url.Hostname(), url.Port())
+	wsURL := websocketURL(url)
 
 	wsClient, wsErr := model.NewWebSocketClient(wsURL, m.client.AuthToken)
 	if wsErr != nil {
@@ -84,41 +122,53 @@ func (m *Mattermost) Listen() (<-chan Message, <-chan error, error) {
 	}
 
 	msgC := make(chan Message, 100)
-	errC := make(chan error)
+	errC := make(chan error, 1)
 	go func() {
 		wsClient.Listen()
 		defer wsClient.Close()
 
 		for {
-			event := <-wsClient.EventChannel
+			var event *model.WebSocketEvent
+			select {
+			case event = <-wsClient.EventChannel:
+			case <-ctx.Done():
+				logger.Debug("stop listening - close websocket connection")
+				return
+			}
+
 			if event == nil {
 				errC <- errors.New("'nil' event received - disconnected?")
 				return
-			} else if event.Event == model.WEBSOCKET_EVENT_POSTED {
-				if post := model.PostFromJson(strings.NewReader(event.Data["post"].(string))); post != nil {
-					// TODO: maybe cache the 'userName' and 'channelName'?
-
-					userName := "id:" + post.UserId
-					if user, err := m.GetUser(post.UserId); err == nil {
-						userName = user.Username
-					}
-
-					channelName := "id:" + post.ChannelId
-					if channel, err := m.GetChannel(post.ChannelId); err == nil {
-						channelName = channel.Name
-					}
-
-					msg := Message{
-						ID:          post.Id,
-						UserID:      post.UserId,
-						UserName:    userName,
-						ChannelID:   post.ChannelId,
-						ChannelName: channelName,
-						Content:     post.Message,
-					}
-					logger.Debugf("publish new message from: '%s', in channel: '%s'", userName, channelName)
-					msgC <- msg
-				}
+			}
+
+			m.invalidateCache(event)
+
+			var msgEvent Event
+			switch event.Event {
+			case model.WEBSOCKET_EVENT_POSTED:
+				msgEvent = Posted
+			case model.WEBSOCKET_EVENT_POST_EDITED:
+				msgEvent = Edited
+			case model.WEBSOCKET_EVENT_POST_DELETED:
+				msgEvent = Deleted
+			default:
+				continue
+			}
+
+			// the own posts (like the relayed mail replies) are not forwarded
+			data, _ := event.Data["post"].(string)
+			post := model.PostFromJson(strings.NewReader(data))
+			if post == nil || post.UserId == m.userID {
+				continue
+			}
+
+			msg := m.toMessage(post)
+			msg.Event = msgEvent
+			logger.Debugf("publish %s message from: '%s', in channel: '%s'", msgEvent, msg.UserName, msg.ChannelName)
+			select {
+			case msgC <- msg:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -126,7 +176,198 @@ func (m *Mattermost) Listen() (<-chan Message, <-chan error, error) {
 	return msgC, errC, nil
 }
 
+// PostsSince returns all posts which are created after the given timestamp
+// in all channels the bot belongs to.
+//
+// it's used to backfill the posts which are missed while the websocket
+// was disconnected. the posts are ordered by their create-timestamp,
+// deleted posts are skipped.
+func (m *Mattermost) PostsSince(since int64) ([]Message, error) {
+	logger.Debugf("try to lookup posts since: %d", since)
+
+	etag := ""
+	teams, resp := m.client.GetTeamsForUser(m.userID, etag)
+	if resp.Error != nil {
+		return nil, fmt.Errorf("unable to lookup teams: %s", detailedErrOrMsg(resp))
+	}
+
+	// direct and group messages are listed in each team - so the channels
+	// and posts are collected per id
+	seenChannels := map[string]bool{}
+	seenPosts := map[string]bool{}
+	posts := []*model.Post{}
+	for _, team := range teams {
+		channels, resp := m.client.GetChannelsForTeamForUser(team.Id, m.userID, etag)
+		if resp.Error != nil {
+			return nil, fmt.Errorf("unable to lookup channels in team: '%s': %s", team.Name, detailedErrOrMsg(resp))
+		}
+
+		for _, channel := range channels {
+			if seenChannels[channel.Id] {
+				continue
+			}
+			seenChannels[channel.Id] = true
+
+			postList, resp := m.client.GetPostsSince(channel.Id, since)
+			if resp.Error != nil {
+				return nil, fmt.Errorf("unable to lookup posts in channel: '%s': %s", channel.Name, detailedErrOrMsg(resp))
+			}
+
+			for _, post := range postList.Posts {
+				// 'GetPostsSince' also returns posts which are only updated or
+				// deleted since the given timestamp
+				if post.CreateAt <= since || post.DeleteAt != 0 || post.UserId == m.userID || seenPosts[post.Id] {
+					continue
+				}
+				seenPosts[post.Id] = true
+				posts = append(posts, post)
+			}
+		}
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].CreateAt < posts[j].CreateAt
+	})
+
+	msgs := make([]Message, 0, len(posts))
+	for _, post := range posts {
+		msgs = append(msgs, m.toMessage(post))
+	}
+
+	logger.Debugf("%d posts since: %d found", len(msgs), since)
+	return msgs, nil
+}
+
+// ServerTime returns the current time of the mattermost server in
+// milliseconds - it's taken from the 'Date' header, so it has a resolution
+// of one second
+func (m *Mattermost) ServerTime() (int64, error) {
+	resp, appErr := m.client.DoApiGet("/system/ping", "")
+	if appErr != nil {
+		return 0, fmt.Errorf("unable to ping the server: %s", appErr.Error())
+	}
+	defer resp.Body.Close()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid server time: %s", err.Error())
+	}
+	return date.UnixNano() / int64(time.Millisecond), nil
+}
+
+// Message looks up the message with the given id
+func (m *Mattermost) Message(id string) (*Message, error) {
+	post, resp := m.client.GetPost(id, "")
+	if resp.Error != nil {
+		return nil, fmt.Errorf("unable to lookup post: '%s': %s", id, detailedErrOrMsg(resp))
+	}
+
+	msg := m.toMessage(post)
+	return &msg, nil
+}
+
+// toMessage converts the given mattermost post to a chat message
+func (m *Mattermost) toMessage(post *model.Post) Message {
+	userName := "id:" + post.UserId
+	if user, err := m.GetUser(post.UserId); err == nil {
+		userName = user.Username
+	}
+
+	// direct messages are not in any team
+	var teamID string
+	channelName := "id:" + post.ChannelId
+	if channel, err := m.GetChannel(post.ChannelId); err == nil {
+		channelName = channel.Name
+		teamID = channel.TeamId
+	}
+
+	return Message{
+		ID:          post.Id,
+		UserID:      post.UserId,
+		UserName:    userName,
+		TeamID:      teamID,
+		ChannelID:   post.ChannelId,
+		ChannelName: channelName,
+		Content:     post.Message,
+		CreateAt:    post.CreateAt,
+		EditAt:      post.EditAt,
+		RootID:      post.RootId,
+		FileIDs:     post.FileIds,
+	}
+}
+
+// Files looks up the infos of the files of the message - the content is
+// downloaded on demand per 'FileContent'. files which can't be looked up
+// are logged and skipped.
+func (m *Mattermost) Files(msg *Message) []File {
+	files := []File{}
+	for _, id := range msg.FileIDs {
+		info, resp := m.client.GetFileInfo(id)
+		if resp.Error != nil {
+			logger.Errorf("unable to lookup file: %s - error: %s", id, detailedErrOrMsg(resp))
+			continue
+		}
+
+		files = append(files, File{
+			ID:       info.Id,
+			Name:     info.Name,
+			MimeType: info.MimeType,
+			Size:     info.Size,
+			Link:     m.fileLink(msg.ID, info.Id),
+		})
+	}
+	return files
+}
+
+// fileLink returns the public link of the file - the mail recipients need no
+// chat account to download it. public links must be enabled in mattermost,
+// otherwise the permalink of the post is returned.
+func (m *Mattermost) fileLink(postID, fileID string) string {
+	link, resp := m.client.GetFileLink(fileID)
+	if resp.Error == nil && link != "" {
+		return link
+	}
+
+	if resp.Error != nil {
+		logger.Debugf("no public link for file: %s - error: %s", fileID, detailedErrOrMsg(resp))
+	}
+	return strings.TrimRight(m.client.Url, "/") + "/_redirect/pl/" + postID
+}
+
+// FileContent downloads the given file
+func (m *Mattermost) FileContent(file *File) ([]byte, error) {
+	data, resp := m.client.GetFile(file.ID)
+	if resp.Error != nil {
+		return nil, fmt.Errorf("unable to download file: '%s': %s", file.Name, detailedErrOrMsg(resp))
+	}
+	return data, nil
+}
+
+// websocketURL derives the websocket endpoint from the mattermost url.
+//
+//   * 'https' urls are mapped to 'wss', everything else to 'ws'
+//   * the port is only set if the url contains one - otherwise the default port is used
+//   * a path prefix (mattermost behind a reverse proxy at a sub-path) is kept
+func websocketURL(mattermostURL *url.URL) string {
+	scheme := "ws"
+	if mattermostURL.Scheme == "https" {
+		scheme = "wss"
+	}
+
+	wsURL := url.URL{
+		Scheme: scheme,
+		Host:   mattermostURL.Host,
+		Path:   strings.TrimRight(mattermostURL.Path, "/"),
+	}
+	return wsURL.String()
+}
+
+// GetUser returns the user with the given id - the user is cached
 func (m *Mattermost) GetUser(userID string) (*model.User, error) {
+	if user, found := m.users.get(userID); found {
+		return user.(*model.User), nil
+	}
+
 	logger.Debugf("try to lookup user by id: '%s'", userID)
 
 	etag := ""
@@ -137,10 +378,16 @@ func (m *Mattermost) GetUser(userID string) (*model.User, error) {
 	}
 
 	logger.Debugf("user with id: '%s' found, user: %+v", userID, user)
+	m.users.put(userID, user)
 	return user, nil
 }
 
+// GetChannel returns the channel with the given id - the channel is cached
 func (m *Mattermost) GetChannel(channelID string) (*model.Channel, error) {
+	if channel, found := m.channels.get(channelID); found {
+		return channel.(*model.Channel), nil
+	}
+
 	logger.Debugf("try to lookup channel by id: '%s'", channelID)
 
 	etag := ""
@@ -151,10 +398,16 @@ func (m *Mattermost) GetChannel(channelID string) (*model.Channel, error) {
 	}
 
 	logger.Debugf("channel with id: '%s' found, channel: %+v", channelID, channel)
+	m.channels.put(channelID, channel)
 	return channel, nil
 }
 
+// GetTeamByName returns the team with the given name - the team is cached
 func (m *Mattermost) GetTeamByName(name string) (*model.Team, error) {
+	if team, found := m.teams.get(name); found {
+		return team.(*model.Team), nil
+	}
+
 	logger.Debugf("try to lookup team by name: '%s'", name)
 
 	etag := ""
@@ -165,10 +418,17 @@ func (m *Mattermost) GetTeamByName(name string) (*model.Team, error) {
 	}
 
 	logger.Debugf("team with name: '%s' found, team: %+v", name, team)
+	m.teams.put(name, team)
 	return team, nil
 }
 
+// GetChannelByName returns the channel with the given name in the team - the channel is cached
 func (m *Mattermost) GetChannelByName(name string, team *model.Team) (*model.Channel, error) {
+	key := team.Id + "/" + name
+	if channel, found := m.channels.get(key); found {
+		return channel.(*model.Channel), nil
+	}
+
 	logger.Debugf("try to lookup channel by name: %s, in team: %s", name, team.Name)
 
 	etag := ""
@@ -179,9 +439,153 @@ func (m *Mattermost) GetChannelByName(name string, team *model.Team) (*model.Cha
 	}
 
 	logger.Debugf("channel with name: '%s' in team: '%s' found, channel: %+v", name, team.Name, channel)
+	m.channels.put(key, channel)
 	return channel, nil
 }
 
+// TeamID resolves the team name to the team id
+func (m *Mattermost) TeamID(teamName string) (string, error) {
+	team, err := m.GetTeamByName(teamName)
+	if err != nil {
+		return "", err
+	}
+	return team.Id, nil
+}
+
+// ChannelID resolves the channel name in the given team to the channel id
+func (m *Mattermost) ChannelID(teamName, channelName string) (string, error) {
+	team, err := m.GetTeamByName(teamName)
+	if err != nil {
+		return "", err
+	}
+
+	channel, err := m.GetChannelByName(channelName, team)
+	if err != nil {
+		return "", err
+	}
+	return channel.Id, nil
+}
+
+// Sender returns the roles and groups of the author of the given message
+func (m *Mattermost) Sender(msg *Message) (*Sender, error) {
+	user, err := m.GetUser(msg.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		UserName: user.Username,
+		Roles:    strings.Fields(user.Roles),
+	}
+
+	etag := ""
+	// direct messages are not in any team
+	if msg.TeamID != "" {
+		member, resp := m.client.GetTeamMember(msg.TeamID, msg.UserID, etag)
+		if resp.Error != nil {
+			return nil, fmt.Errorf("team member with id: '%s' not found: %s", msg.UserID, detailedErrOrMsg(resp))
+		}
+		sender.Roles = append(sender.Roles, strings.Fields(member.Roles)...)
+	}
+
+	member, resp := m.client.GetChannelMember(msg.ChannelID, msg.UserID, etag)
+	if resp.Error != nil {
+		return nil, fmt.Errorf("channel member with id: '%s' not found: %s", msg.UserID, detailedErrOrMsg(resp))
+	}
+	sender.Roles = append(sender.Roles, strings.Fields(member.Roles)...)
+
+	// groups are not available in all mattermost editions
+	if sender.Groups, err = m.groups(msg.UserID); err != nil {
+		logger.Errorf("unable to lookup groups - error: %s", err.Error())
+	}
+
+	logger.Debugf("sender: %+v", sender)
+	return sender, nil
+}
+
+// groups returns the names of the groups where the user is a member
+func (m *Mattermost) groups(userID string) ([]string, error) {
+	resp, appErr := m.client.DoApiGet(m.client.GetUsersRoute()+"/"+userID+"/groups", "")
+	if appErr != nil {
+		return nil, fmt.Errorf("groups for user with id: '%s' not found: %s", userID, appErr.Error())
+	}
+	defer resp.Body.Close()
+
+	var groups []struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("invalid groups for user with id: '%s': %s", userID, err.Error())
+	}
+
+	names := []string{}
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return names, nil
+}
+
+// CacheStats returns the hit and miss counts of the user, channel and team caches
+func (m *Mattermost) CacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"users":    m.users.stats(),
+		"channels": m.channels.stats(),
+		"teams":    m.teams.stats(),
+	}
+}
+
+// invalidateCache removes the cache entries which are updated per the given event
+func (m *Mattermost) invalidateCache(event *model.WebSocketEvent) {
+	switch event.Event {
+	case model.WEBSOCKET_EVENT_USER_UPDATED:
+		if id := idFromEventData(event.Data, "user"); id != "" {
+			logger.Debugf("user with id: '%s' updated - remove it from the cache", id)
+			m.users.removeFunc(func(key string, _ interface{}) bool {
+				return key == id
+			})
+		}
+	case model.WEBSOCKET_EVENT_CHANNEL_UPDATED,
+		model.WEBSOCKET_EVENT_CHANNEL_CONVERTED,
+		model.WEBSOCKET_EVENT_CHANNEL_DELETED:
+		id := idFromEventData(event.Data, "channel")
+		if id == "" {
+			id, _ = event.Data["channel_id"].(string)
+		}
+		if id != "" {
+			logger.Debugf("channel with id: '%s' changed - remove it from the cache", id)
+			// the channel is cached per id and per name
+			m.channels.removeFunc(func(_ string, value interface{}) bool {
+				return value.(*model.Channel).Id == id
+			})
+		}
+	case model.WEBSOCKET_EVENT_UPDATE_TEAM:
+		if id := idFromEventData(event.Data, "team"); id != "" {
+			logger.Debugf("team with id: '%s' updated - remove it from the cache", id)
+			m.teams.removeFunc(func(_ string, value interface{}) bool {
+				return value.(*model.Team).Id == id
+			})
+		}
+	}
+}
+
+// idFromEventData returns the 'id' of the object in the given event data field.
+// the object can be a json string or an already decoded json object.
+func idFromEventData(data map[string]interface{}, field string) string {
+	switch obj := data[field].(type) {
+	case map[string]interface{}:
+		id, _ := obj["id"].(string)
+		return id
+	case string:
+		var x struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(obj), &x); err == nil {
+			return x.ID
+		}
+	}
+	return ""
+}
+
 // try to get the detailed error message from the response.
 // if it's empty, return the general error message
 func detailedErrOrMsg(resp *model.Response) string {
@@ -0,0 +1,357 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattermost/platform/model"
+)
+
+func TestWebsocketURL(t *testing.T) {
+	tests := []struct {
+		mattermostURL string
+		expected      string
+	}{
+		{"http://127.0.0.1:8065", "ws://127.0.0.1:8065"},
+		{"https://chat.example.com", "wss://chat.example.com"},
+		{"https://chat.example.com:8443", "wss://chat.example.com:8443"},
+		{"https://example.com/mattermost", "wss://example.com/mattermost"},
+		{"https://example.com/mattermost/", "wss://example.com/mattermost"},
+		{"http://example.com/chat/mattermost", "ws://example.com/chat/mattermost"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.mattermostURL)
+		if err != nil {
+			t.Fatalf("invalid test url: %s - error: %s", test.mattermostURL, err.Error())
+		}
+
+		if wsURL := websocketURL(u); wsURL != test.expected {
+			t.Errorf("websocket url for '%s' - expected: '%s', received: '%s'", test.mattermostURL, test.expected, wsURL)
+		}
+	}
+}
+
+// the derived websocket url should reach a mattermost instance
+// which runs https-only behind a reverse proxy at a sub-path
+func TestWebsocketURLReachesTLSServerAtSubPath(t *testing.T) {
+	subPath := "/mattermost"
+	endpoint := subPath + model.API_URL_SUFFIX_V3 + "/users/websocket"
+
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
+		con, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer con.Close()
+		con.WriteMessage(websocket.TextMessage, []byte("hello"))
+	})
+
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + subPath)
+	wsURL := websocketURL(u)
+	if u.Scheme != "https" || wsURL[:6] != "wss://" {
+		t.Fatalf("expected a 'wss' url for: %s, received: %s", u, wsURL)
+	}
+
+	// trust the self-signed certificate from the stand-in
+	dialer := websocket.Dialer{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone(),
+	}
+	con, _, err := dialer.Dial(wsURL+model.API_URL_SUFFIX_V3+"/users/websocket", nil)
+	if err != nil {
+		t.Fatalf("unable to connect to: %s - error: %s", wsURL, err.Error())
+	}
+	defer con.Close()
+
+	if _, ok := con.UnderlyingConn().(*tls.Conn); !ok {
+		t.Errorf("websocket connection is not encrypted")
+	}
+
+	if _, msg, err := con.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("unexpected message from stand-in: '%s' - error: %v", msg, err)
+	}
+}
+
+// websocket events should invalidate the cached users, channels and teams
+func TestInvalidateCache(t *testing.T) {
+	m := &Mattermost{
+		users:    newCache(10, time.Hour),
+		channels: newCache(10, time.Hour),
+		teams:    newCache(10, time.Hour),
+	}
+
+	fill := func() {
+		m.users.put("user-1", &model.User{Id: "user-1"})
+		m.channels.put("channel-1", &model.Channel{Id: "channel-1"})
+		m.channels.put("team-1/town-square", &model.Channel{Id: "channel-1"})
+		m.channels.put("channel-2", &model.Channel{Id: "channel-2"})
+		m.teams.put("team", &model.Team{Id: "team-1"})
+	}
+
+	tests := []struct {
+		event   *model.WebSocketEvent
+		removed map[*cache][]string
+	}{
+		{
+			&model.WebSocketEvent{
+				Event: model.WEBSOCKET_EVENT_USER_UPDATED,
+				Data:  map[string]interface{}{"user": map[string]interface{}{"id": "user-1"}},
+			},
+			map[*cache][]string{m.users: []string{"user-1"}},
+		},
+		{
+			&model.WebSocketEvent{
+				Event: model.WEBSOCKET_EVENT_CHANNEL_UPDATED,
+				Data:  map[string]interface{}{"channel": `{"id": "channel-1"}`},
+			},
+			map[*cache][]string{m.channels: []string{"channel-1", "team-1/town-square"}},
+		},
+		{
+			&model.WebSocketEvent{
+				Event: model.WEBSOCKET_EVENT_CHANNEL_CONVERTED,
+				Data:  map[string]interface{}{"channel_id": "channel-2"},
+			},
+			map[*cache][]string{m.channels: []string{"channel-2"}},
+		},
+		{
+			&model.WebSocketEvent{
+				Event: model.WEBSOCKET_EVENT_UPDATE_TEAM,
+				Data:  map[string]interface{}{"team": `{"id": "team-1"}`},
+			},
+			map[*cache][]string{m.teams: []string{"team"}},
+		},
+	}
+
+	for _, test := range tests {
+		fill()
+		m.invalidateCache(test.event)
+
+		for c, keys := range test.removed {
+			for _, key := range keys {
+				if _, found := c.get(key); found {
+					t.Errorf("event: %s - entry '%s' should be removed", test.event.Event, key)
+				}
+			}
+		}
+
+		if _, found := m.channels.get("channel-2"); !found && test.event.Event != model.WEBSOCKET_EVENT_CHANNEL_CONVERTED {
+			t.Errorf("event: %s - unrelated entry 'channel-2' should be cached", test.event.Event)
+		}
+	}
+}
+
+// startMattermostStandIn starts a mattermost stand-in which returns the given
+// json responses per api path (like: '/users/me')
+func startMattermostStandIn(t *testing.T, responses map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	for path, response := range responses {
+		response := response
+		mux.HandleFunc(model.API_URL_SUFFIX_V4+path, func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(response)
+		})
+	}
+	return httptest.NewServer(mux)
+}
+
+// direct messages are listed in each team of the bot - they should be
+// backfilled only once, and deleted posts should be skipped
+func TestPostsSinceWithDirectMessagesInMultipleTeams(t *testing.T) {
+	dm := &model.Channel{Id: "dm", Name: "bot__user", Type: "D"}
+	server := startMattermostStandIn(t, map[string]interface{}{
+		"/users/bot/teams": []*model.Team{{Id: "team-1", Name: "one"}, {Id: "team-2", Name: "two"}},
+		"/users/bot/teams/team-1/channels": []*model.Channel{
+			{Id: "town-square", TeamId: "team-1", Name: "town-square"}, dm,
+		},
+		"/users/bot/teams/team-2/channels": []*model.Channel{dm},
+		"/channels/town-square/posts": &model.PostList{Posts: map[string]*model.Post{
+			"1": {Id: "1", ChannelId: "town-square", UserId: "user", CreateAt: 90, UpdateAt: 110, Message: "edited"},
+			"2": {Id: "2", ChannelId: "town-square", UserId: "user", CreateAt: 120, Message: "missed"},
+			"3": {Id: "3", ChannelId: "town-square", UserId: "bot", CreateAt: 130, Message: "own post"},
+		}},
+		"/channels/dm/posts": &model.PostList{Posts: map[string]*model.Post{
+			"4": {Id: "4", ChannelId: "dm", UserId: "user", CreateAt: 110, Message: "direct message"},
+			"5": {Id: "5", ChannelId: "dm", UserId: "user", CreateAt: 140, DeleteAt: 150, Message: "deleted"},
+		}},
+	})
+	defer server.Close()
+
+	m := newMattermost(model.NewAPIv4Client(server.URL), "bot")
+	msgs, err := m.PostsSince(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	if strings.Join(ids, ",") != "4,2" {
+		t.Errorf("expected the posts: 4,2 - found: %v", ids)
+	}
+}
+
+// the server time should be taken from the 'Date' header
+func TestServerTime(t *testing.T) {
+	server := startMattermostStandIn(t, map[string]interface{}{
+		"/system/ping": map[string]string{"status": "OK"},
+	})
+	defer server.Close()
+
+	before := time.Now().Truncate(time.Second).UnixNano() / int64(time.Millisecond)
+	m := newMattermost(model.NewAPIv4Client(server.URL), "bot")
+	ts, err := m.ServerTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now := time.Now().UnixNano() / int64(time.Millisecond); ts < before || ts > now {
+		t.Errorf("expected a server time between: %d and %d, found: %d", before, now, ts)
+	}
+}
+
+// the access token should be sent per 'Authorization: Bearer' header to the
+// rest api, and per authentication challenge to the websocket
+func TestConnectWithToken(t *testing.T) {
+	var mutex sync.Mutex
+	authHeaders := []string{}
+	wsTokenC := make(chan string, 1)
+
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(model.API_URL_SUFFIX_V4+"/", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		mutex.Unlock()
+
+		if fields := strings.Fields(r.Header.Get("Authorization")); len(fields) != 2 ||
+			!strings.EqualFold(fields[0], "bearer") || fields[1] != "secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(model.AppError{Message: "invalid or expired session"})
+			return
+		}
+		json.NewEncoder(w).Encode(&model.User{Id: "bot", Username: "matterbot"})
+	})
+	mux.HandleFunc(model.API_URL_SUFFIX_V3+"/users/websocket", func(w http.ResponseWriter, r *http.Request) {
+		con, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer con.Close()
+
+		var challenge struct {
+			Action string `json:"action"`
+			Data   struct {
+				Token string `json:"token"`
+			} `json:"data"`
+		}
+		if err := con.ReadJSON(&challenge); err == nil && challenge.Action == "authentication_challenge" {
+			wsTokenC <- challenge.Data.Token
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	if _, err := ConnectWithToken(u, "wrong-token"); err == nil || !strings.HasPrefix(err.Error(), "invalid access token: ") {
+		t.Errorf("expected an error for the wrong token - found: %v", err)
+	}
+
+	m, err := ConnectWithToken(u, "secret-token")
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err.Error())
+	}
+	if m.userID != "bot" {
+		t.Errorf("expected the user of the token: 'bot', found: '%s'", m.userID)
+	}
+	if user, err := m.GetUser("user"); err != nil || user.Username != "matterbot" {
+		t.Errorf("rest api call failed: %v", err)
+	}
+
+	// the first request is the one with the wrong token
+	mutex.Lock()
+	for i, header := range authHeaders[1:] {
+		if !strings.EqualFold(header, "bearer secret-token") {
+			t.Errorf("request %d - unexpected authorization header: '%s'", i+2, header)
+		}
+	}
+	mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := m.Listen(ctx); err != nil {
+		t.Fatalf("unable to connect to the websocket: %s", err.Error())
+	}
+	select {
+	case token := <-wsTokenC:
+		if token != "secret-token" {
+			t.Errorf("unexpected token for the websocket: '%s'", token)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no authentication challenge from the websocket")
+	}
+}
+
+// the files should be linked per public link - per permalink of the post
+// if the public links are disabled
+func TestFileLinks(t *testing.T) {
+	server := startMattermostStandIn(t, map[string]interface{}{
+		"/files/public/info":  &model.FileInfo{Id: "public", Name: "a.pdf"},
+		"/files/public/link":  map[string]string{"link": "https://chat.example.com/files/public/public?h=hash"},
+		"/files/private/info": &model.FileInfo{Id: "private", Name: "b.pdf"},
+	})
+	defer server.Close()
+
+	m := newMattermost(model.NewAPIv4Client(server.URL), "bot")
+	files := m.Files(&Message{ID: "post", FileIDs: []string{"public", "private"}})
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, found: %+v", files)
+	}
+
+	if files[0].Link != "https://chat.example.com/files/public/public?h=hash" {
+		t.Errorf("expected the public link, found: %s", files[0].Link)
+	}
+	if files[1].Link != server.URL+"/_redirect/pl/post" {
+		t.Errorf("expected the permalink of the post, found: %s", files[1].Link)
+	}
+}
+
+// the file infos should not be looked up for each post - only per 'Files'
+func TestToMessageWithoutFileLookup(t *testing.T) {
+	var mutex sync.Mutex
+	paths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		paths = append(paths, r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	m := newMattermost(model.NewAPIv4Client(server.URL), "bot")
+	msg := m.toMessage(&model.Post{Id: "post", UserId: "user", ChannelId: "channel", FileIds: []string{"file"}})
+	if len(msg.FileIDs) != 1 || msg.FileIDs[0] != "file" {
+		t.Errorf("expected the file id: 'file', found: %v", msg.FileIDs)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, path := range paths {
+		if strings.Contains(path, "/files/") {
+			t.Errorf("unexpected file lookup: %s", path)
+		}
+	}
+}
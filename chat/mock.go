@@ -1,6 +1,9 @@
 package chat
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/section77/matterbot/logger"
@@ -10,7 +13,31 @@ import (
 type ServerMock struct {
 	connected bool
 
-	Messages []*Message
+	mutex    sync.Mutex
+	messages []*Message
+
+	// messages which are returned from 'PostsSince'
+	Backlog []Message
+
+	// timestamp which is returned from 'ServerTime' - the local time if not set
+	Time int64
+
+	// messages which are returned from 'Message' (key: message id)
+	Posts map[string]Message
+
+	// ids which are returned from 'TeamID' (key: team name) and
+	// 'ChannelID' (key: '<team name>/<channel name>')
+	TeamIDs    map[string]string
+	ChannelIDs map[string]string
+
+	// senders which are returned from 'Sender' (key: user id)
+	Senders map[string]*Sender
+
+	// files which are returned from 'Files' (key: file id)
+	FileInfos map[string]File
+
+	// file contents which are returned from 'FileContent' (key: file id)
+	FileContents map[string][]byte
 
 	msgC chan Message
 	errC chan error
@@ -30,21 +57,102 @@ func (mock *ServerMock) IsConnected() bool {
 	return mock.connected
 }
 
-// Send emulates an send-action and saves all messages in the mock// Send emulates an send-action and saves all messages in the mock
+// Send emulates an send-action and saves all messages in the mock
 func (mock *ServerMock) Send(msg *Message) error {
 	logger.Debugf("send per chat in channel: %s message: %s", msg.ChannelName, msg.Content)
-	mock.Messages = append(mock.Messages, msg)
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.messages = append(mock.messages, msg)
 	return nil
 }
 
+// Messages returns a copy of the sent messages
+func (mock *ServerMock) Messages() []*Message {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	return append([]*Message{}, mock.messages...)
+}
+
 // Listen returns a channel with chat messages and one with error messages.
 //  * chat messages can be triggered per 'TriggerMsgEvent'
 //  * error events can be triggered per 'TriggerErrorevent'
 // on this mock
-func (mock *ServerMock) Listen() (<-chan Message, <-chan error, error) {
+func (mock *ServerMock) Listen(ctx context.Context) (<-chan Message, <-chan error, error) {
 	return mock.msgC, mock.errC, nil
 }
 
+// PostsSince returns all messages from 'ServerMock.Backlog'
+// which are created after the given timestamp
+func (mock *ServerMock) PostsSince(since int64) ([]Message, error) {
+	msgs := []Message{}
+	for _, msg := range mock.Backlog {
+		if msg.CreateAt > since {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// ServerTime returns 'ServerMock.Time' or the local time in milliseconds
+func (mock *ServerMock) ServerTime() (int64, error) {
+	if mock.Time != 0 {
+		return mock.Time, nil
+	}
+	return time.Now().UnixNano() / int64(time.Millisecond), nil
+}
+
+// Message returns the message from 'ServerMock.Posts'
+func (mock *ServerMock) Message(id string) (*Message, error) {
+	if msg, found := mock.Posts[id]; found {
+		return &msg, nil
+	}
+	return nil, fmt.Errorf("message: '%s' not found", id)
+}
+
+// Sender returns the sender from 'ServerMock.Senders' - a sender
+// without roles and groups if it's not found
+func (mock *ServerMock) Sender(msg *Message) (*Sender, error) {
+	if sender, found := mock.Senders[msg.UserID]; found {
+		return sender, nil
+	}
+	return &Sender{UserName: msg.UserName}, nil
+}
+
+// Files returns the files of the message from 'ServerMock.FileInfos' - unknown files are skipped
+func (mock *ServerMock) Files(msg *Message) []File {
+	files := []File{}
+	for _, id := range msg.FileIDs {
+		if f, found := mock.FileInfos[id]; found {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// FileContent returns the content from 'ServerMock.FileContents'
+func (mock *ServerMock) FileContent(file *File) ([]byte, error) {
+	if data, found := mock.FileContents[file.ID]; found {
+		return data, nil
+	}
+	return nil, fmt.Errorf("file: '%s' not found", file.Name)
+}
+
+// TeamID returns the id from 'ServerMock.TeamIDs'
+func (mock *ServerMock) TeamID(teamName string) (string, error) {
+	if id, found := mock.TeamIDs[teamName]; found {
+		return id, nil
+	}
+	return "", fmt.Errorf("team with name: '%s' not found", teamName)
+}
+
+// ChannelID returns the id from 'ServerMock.ChannelIDs'
+func (mock *ServerMock) ChannelID(teamName, channelName string) (string, error) {
+	if id, found := mock.ChannelIDs[teamName+"/"+channelName]; found {
+		return id, nil
+	}
+	return "", fmt.Errorf("channel with name: '%s' in team: '%s' not found", channelName, teamName)
+}
+
 // TriggerMsgEvent triggers an event in the 'Message channel'
 // which is returned from the 'Listen' function
 func (mock *ServerMock) TriggerMsgEvent(msg Message) {
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/namsral/flag"
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// config represents the content of the config file.
+//
+// the config file is a yaml file with the flag names as keys. the 'forward'
+// setting accepts the flag format, or a list of forward rules:
+//
+//	mattermost-url: https://chat.example.com
+//	mail-host: smtp.example.com:465
+//	mail-use-tls: true
+//	forward:
+//	  - marker: ml
+//	    name: Mailing list
+//	    to: ml@example.com
+//	    bcc: archive@example.com
+//	    subject: "[ml] {{.User}} writes in channel {{.Channel}}"
+//	    body: "{{.Content}}"
+//	    allow-channels: [team/announcements]
+//	    roles: [channel_admin, system_admin]
+//	    retractions: false
+//	  - any: [{hashtag: incident}, {regex: '(?i)outage'}]
+//	    to: oncall@example.com
+//
+// settings from the command line or from environment variables
+// overrides the settings from the config file.
+type config struct {
+	file     string
+	settings []configSetting
+
+	// forward rules - 'nil' if the 'forward' setting isn't a list
+	fwdMappings []fwdMapping
+}
+
+// configSetting is a single 'flag-name: value' setting in the config file
+type configSetting struct {
+	name  string
+	value string
+	line  int
+}
+
+// settings which are not allowed in the config file
+var configIgnoredFlags = map[string]bool{
+	"config-file": true,
+	"v":           true,
+}
+
+// flagDefaults contains the flag values from the command line, environment
+// variables or the flag defaults - before the config file is applied. the
+// config file is applied onto them on each reload, so a setting which is
+// removed from the config file falls back to its default.
+var flagDefaults = map[string]string{}
+
+// saveFlagDefaults saves the current flag values - before the config file is applied
+func saveFlagDefaults() {
+	flag.VisitAll(func(f *flag.Flag) {
+		flagDefaults[f.Name] = f.Value.String()
+	})
+}
+
+// flagDefault returns the value of the given flag before the config file was applied
+func flagDefault(name string) string {
+	if value, found := flagDefaults[name]; found {
+		return value
+	}
+	return flag.Lookup(name).Value.String()
+}
+
+// readConfig reads and validates the given config file
+func readConfig(file string) (*config, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %s", err.Error())
+	}
+	return parseConfig(file, buf)
+}
+
+// parseConfig parses and validates the given config file content
+func parseConfig(file string, buf []byte) (*config, error) {
+	cfg := &config{file: file}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+
+	// empty file
+	if len(doc.Content) == 0 {
+		return cfg, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, cfg.errorf(root, "expected a mapping with 'setting: value' pairs")
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		if key.Value == "forward" && value.Kind == yaml.SequenceNode {
+			mappings, err := cfg.parseFwdRules(value)
+			if err != nil {
+				return nil, err
+			}
+			cfg.fwdMappings = mappings
+			continue
+		}
+
+		if flag.Lookup(key.Value) == nil || configIgnoredFlags[key.Value] {
+			return nil, cfg.errorf(key, "unknown setting: '%s'", key.Value)
+		}
+
+		// a list is joined to a comma separated value - like in the flags
+		if value.Kind == yaml.SequenceNode {
+			xs, err := cfg.list(key, value)
+			if err != nil {
+				return nil, err
+			}
+			cfg.settings = append(cfg.settings, configSetting{key.Value, strings.Join(xs, ","), value.Line})
+			continue
+		}
+
+		if value.Kind != yaml.ScalarNode {
+			return nil, cfg.errorf(value, "setting: '%s' expects a single value or a list", key.Value)
+		}
+		cfg.settings = append(cfg.settings, configSetting{key.Value, value.Value, value.Line})
+	}
+	return cfg, nil
+}
+
+// apply sets all flags from the config file, which are not already
+// set per command line or environment variable
+func (cfg *config) apply() error {
+	for _, s := range cfg.settings {
+		if explicitFlags[s.name] {
+			logger.Debugf("setting: '%s' from the config file is overridden", s.name)
+			continue
+		}
+
+		if err := flag.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for setting: '%s': %s", cfg.file, s.line, s.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// setting returns the value of the given setting from the config file.
+// if it's not in the config file, or overridden per command line or
+// environment variable, the given default value is returned.
+func (cfg *config) setting(name, defaultValue string) string {
+	if explicitFlags[name] {
+		return defaultValue
+	}
+
+	for _, s := range cfg.settings {
+		if s.name == name {
+			return s.value
+		}
+	}
+	return defaultValue
+}
+
+// rules returns the forward rules from the config file - 'nil' if the
+// config file contains no rules, or the 'forward' flag overrides them
+func (cfg *config) rules() []fwdMapping {
+	if explicitFlags["forward"] {
+		return nil
+	}
+	return cfg.fwdMappings
+}
+
+// parseFwdRules parses the forward rules - each rule is expanded
+// to a fwdMapping per mail-address
+func (cfg *config) parseFwdRules(node *yaml.Node) ([]fwdMapping, error) {
+	fwdMappings := []fwdMapping{}
+	for _, rule := range node.Content {
+		if rule.Kind != yaml.MappingNode {
+			return nil, cfg.errorf(rule, "forward rule expects a mapping with: 'marker', 'to', ...")
+		}
+
+		var marker string
+		var addrs, ccAddrs, bccAddrs, teams, notTeams, channels, notChannels, senders, groups, roles []string
+		var matchers []matcher
+		var strip *bool
+		opts := &fwdOptions{}
+
+		for i := 0; i+1 < len(rule.Content); i += 2 {
+			key, value := rule.Content[i], rule.Content[i+1]
+
+			var err error
+			switch key.Value {
+			case "marker":
+				marker, err = cfg.scalar(key, value)
+				marker = strings.TrimPrefix(marker, "@")
+			case "hashtag", "regex", "all", "any":
+				var m matcher
+				if m, err = cfg.matcher(key, value); err == nil {
+					matchers = append(matchers, m)
+				}
+			case "strip":
+				var b bool
+				if b, err = cfg.bool(key, value); err == nil {
+					strip = &b
+				}
+			case "corrections":
+				var b bool
+				b, err = cfg.bool(key, value)
+				opts.noCorrections = !b
+			case "retractions":
+				var b bool
+				b, err = cfg.bool(key, value)
+				opts.noRetractions = !b
+			case "name":
+				opts.name, err = cfg.scalar(key, value)
+			case "to":
+				addrs, err = cfg.list(key, value)
+			case "cc":
+				ccAddrs, err = cfg.list(key, value)
+			case "bcc":
+				bccAddrs, err = cfg.list(key, value)
+			case "subject":
+				opts.subject, err = cfg.template(key, value)
+			case "body":
+				opts.body, err = cfg.template(key, value)
+			case "html":
+				opts.html, err = cfg.htmlTemplate(key, value)
+			case "allow-teams":
+				teams, err = cfg.list(key, value)
+			case "deny-teams":
+				notTeams, err = cfg.list(key, value)
+			case "allow-channels", "channels":
+				channels, err = cfg.list(key, value)
+			case "deny-channels":
+				notChannels, err = cfg.list(key, value)
+			case "senders":
+				senders, err = cfg.list(key, value)
+			case "groups":
+				groups, err = cfg.list(key, value)
+			case "roles":
+				roles, err = cfg.list(key, value)
+			default:
+				err = cfg.errorf(key, "unknown forward rule setting: '%s'", key.Value)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if marker == "" && len(matchers) == 0 {
+			return nil, cfg.errorf(rule, "forward rule without a 'marker', 'hashtag', 'regex', 'all' or 'any'")
+		}
+
+		// a plain marker rule needs no matcher - other rules matches all given matchers
+		if len(matchers) > 0 || strip != nil {
+			if marker != "" {
+				matchers = append([]matcher{&markerMatcher{marker: marker, strip: true}}, matchers...)
+				marker = ""
+			}
+			opts.matcher = matchers[0]
+			if len(matchers) > 1 {
+				opts.matcher = allMatcher(matchers)
+			}
+			if strip != nil {
+				setStrip(opts.matcher, *strip)
+			}
+		}
+		label := fwdMapping{marker: marker, opts: opts}.label()
+
+		if len(addrs)+len(ccAddrs)+len(bccAddrs) == 0 {
+			return nil, cfg.errorf(rule, "forward rule: '%s' without a mail-address in 'to', 'cc' or 'bcc'", label)
+		}
+
+		var err error
+		if opts.scope, err = newScope(teams, notTeams, channels, notChannels); err != nil {
+			return nil, cfg.errorf(rule, "forward rule: '%s': %s", label, err.Error())
+		}
+		opts.permission = newPermission(senders, groups, roles)
+
+		// the recipients of a rule gets one mail
+		for kind, addrs := range [][]string{rcptTo: addrs, rcptCc: ccAddrs, rcptBcc: bccAddrs} {
+			for _, addr := range addrs {
+				logger.Debugf("forward messages with rule: '%s' to %s (%s)", label, addr, rcptKind(kind))
+				fwdMappings = append(fwdMappings, fwdMapping{marker: marker, mailAddr: addr, rcpt: rcptKind(kind), opts: opts})
+			}
+		}
+	}
+	return fwdMappings, nil
+}
+
+// matcher parses a content matcher:
+//
+//	hashtag: incident             - a single value or a list (any of them)
+//	regex: '(?i)outage'           - a single value or a list (any of them)
+//	all: [{marker: ml}, {hashtag: incident}]
+//	any: [{hashtag: incident}, {regex: '(?i)outage'}]
+//
+// the matched text is only stripped for markers - see the 'strip' setting.
+func (cfg *config) matcher(key, value *yaml.Node) (matcher, error) {
+	ms := []matcher{}
+	switch key.Value {
+	case "marker", "hashtag", "regex":
+		xs, err := cfg.list(key, value)
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range xs {
+			switch key.Value {
+			case "marker":
+				ms = append(ms, &markerMatcher{marker: strings.TrimPrefix(x, "@"), strip: true})
+			case "hashtag":
+				ms = append(ms, &hashtagMatcher{hashtag: strings.TrimPrefix(x, "#")})
+			case "regex":
+				m, err := newRegexMatcher(x)
+				if err != nil {
+					return nil, cfg.errorf(value, "%s", err.Error())
+				}
+				ms = append(ms, m)
+			}
+		}
+		if len(ms) == 1 {
+			return ms[0], nil
+		}
+		return anyMatcher(ms), nil
+
+	case "all", "any":
+		if value.Kind != yaml.SequenceNode || len(value.Content) == 0 {
+			return nil, cfg.errorf(value, "'%s' expects a list of matchers", key.Value)
+		}
+		for _, x := range value.Content {
+			if x.Kind != yaml.MappingNode || len(x.Content) != 2 {
+				return nil, cfg.errorf(x, "'%s' expects matchers like: '{hashtag: incident}'", key.Value)
+			}
+			m, err := cfg.matcher(x.Content[0], x.Content[1])
+			if err != nil {
+				return nil, err
+			}
+			ms = append(ms, m)
+		}
+		if key.Value == "all" {
+			return allMatcher(ms), nil
+		}
+		return anyMatcher(ms), nil
+	}
+	return nil, cfg.errorf(key, "unknown matcher: '%s' - valid: 'marker', 'hashtag', 'regex', 'all' or 'any'", key.Value)
+}
+
+func (cfg *config) scalar(key, value *yaml.Node) (string, error) {
+	if value.Kind != yaml.ScalarNode || value.Value == "" {
+		return "", cfg.errorf(value, "'%s' expects a single value", key.Value)
+	}
+	return value.Value, nil
+}
+
+func (cfg *config) bool(key, value *yaml.Node) (bool, error) {
+	s, err := cfg.scalar(key, value)
+	if err != nil {
+		return false, err
+	}
+	if s != "true" && s != "false" {
+		return false, cfg.errorf(value, "'%s' expects 'true' or 'false'", key.Value)
+	}
+	return s == "true", nil
+}
+
+// list accepts a single value or a list of values
+func (cfg *config) list(key, value *yaml.Node) ([]string, error) {
+	if value.Kind == yaml.ScalarNode {
+		s, err := cfg.scalar(key, value)
+		return []string{s}, err
+	}
+
+	if value.Kind != yaml.SequenceNode {
+		return nil, cfg.errorf(value, "'%s' expects a value or a list of values", key.Value)
+	}
+
+	xs := []string{}
+	for _, x := range value.Content {
+		s, err := cfg.scalar(key, x)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, s)
+	}
+	return xs, nil
+}
+
+func (cfg *config) template(key, value *yaml.Node) (*template.Template, error) {
+	s, err := cfg.scalar(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New(key.Value).Parse(s)
+	if err != nil {
+		return nil, cfg.errorf(value, "invalid template for '%s': %s", key.Value, err.Error())
+	}
+	return t, nil
+}
+
+// htmlTemplate parses a 'html/template' - the content is inserted as sanitized html
+func (cfg *config) htmlTemplate(key, value *yaml.Node) (*htmltemplate.Template, error) {
+	s, err := cfg.scalar(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := htmltemplate.New(key.Value).Parse(s)
+	if err != nil {
+		return nil, cfg.errorf(value, "invalid template for '%s': %s", key.Value, err.Error())
+	}
+	return t, nil
+}
+
+// errorf returns an error with the file name and the line number of the given node
+func (cfg *config) errorf(node *yaml.Node, format string, xs ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", cfg.file, node.Line, fmt.Sprintf(format, xs...))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/namsral/flag"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig("test.yml", []byte(`
+mattermost-url: https://chat.example.com
+mail-use-tls: true
+forward:
+  - marker: "@ml"
+    name: Mailing list
+    to: [ml@example.com, archive@example.com]
+    cc: board@example.com
+    bcc: [audit@example.com]
+    subject: "[ml] {{.User}}"
+    allow-channels: [team/announcements]
+    deny-teams: other-team
+  - marker: user1
+    to: user1@example.com
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expectedSettings := []configSetting{
+		configSetting{"mattermost-url", "https://chat.example.com", 2},
+		configSetting{"mail-use-tls", "true", 3},
+	}
+	if len(cfg.settings) != len(expectedSettings) {
+		t.Fatalf("expected %d settings, received: %+v", len(expectedSettings), cfg.settings)
+	}
+	for i, s := range expectedSettings {
+		if cfg.settings[i] != s {
+			t.Errorf("setting didn't match - expected: %+v, received: %+v", s, cfg.settings[i])
+		}
+	}
+
+	expectedMappings := []fwdMapping{
+		fwdMapping{marker: "ml", mailAddr: "ml@example.com"},
+		fwdMapping{marker: "ml", mailAddr: "archive@example.com"},
+		fwdMapping{marker: "ml", mailAddr: "board@example.com", rcpt: rcptCc},
+		fwdMapping{marker: "ml", mailAddr: "audit@example.com", rcpt: rcptBcc},
+		fwdMapping{marker: "user1", mailAddr: "user1@example.com"},
+	}
+	if len(cfg.fwdMappings) != len(expectedMappings) {
+		t.Fatalf("expected %d forward mappings, received: %+v", len(expectedMappings), cfg.fwdMappings)
+	}
+	for i, m := range expectedMappings {
+		if cfg.fwdMappings[i].marker != m.marker || cfg.fwdMappings[i].mailAddr != m.mailAddr || cfg.fwdMappings[i].rcpt != m.rcpt {
+			t.Errorf("didn't match - expected: %+v, received: %+v", m, cfg.fwdMappings[i])
+		}
+	}
+
+	ml := cfg.fwdMappings[0]
+	if ml.opts.name != "Mailing list" || ml.opts.subject == nil || ml.opts.body != nil {
+		t.Errorf("unexpected options for marker 'ml': %+v", ml.opts)
+	}
+	if ml.opts.scope == nil || ml.opts.scope.allowChannels[0] != "team/announcements" || ml.opts.scope.denyTeams[0] != "other-team" {
+		t.Errorf("unexpected scope for marker 'ml': %+v", ml.opts.scope)
+	}
+	if cfg.fwdMappings[4].opts.scope != nil {
+		t.Errorf("marker 'user1' should be allowed in all teams and channels")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"unknown setting", "mail-host: localhost\nmail-hots: localhost", "test.yml:2: unknown setting: 'mail-hots'"},
+		{"ignored setting", "v: true", "test.yml:1: unknown setting: 'v'"},
+		{"mapping as value", "mail-host:\n  host: localhost", "test.yml:2: setting: 'mail-host' expects a single value or a list"},
+		{"invalid channel", "forward:\n  - marker: ml\n    to: ml@example.com\n    channels: announcements", "test.yml:2: forward rule: '@ml': invalid channel: 'announcements'"},
+		{"rule without marker", "forward:\n  - to: ml@example.com", "test.yml:2: forward rule without a 'marker'"},
+		{"rule without address", "forward:\n  - marker: ml", "test.yml:2: forward rule: '@ml' without a mail-address in 'to', 'cc' or 'bcc'"},
+		{"unknown rule setting", "forward:\n  - marker: ml\n    too: ml@example.com", "test.yml:3: unknown forward rule setting: 'too'"},
+		{"invalid template", "forward:\n  - marker: ml\n    to: ml@example.com\n    body: '{{.Content'", "test.yml:4: invalid template for 'body'"},
+		{"invalid regex", "forward:\n  - regex: '(outage'\n    to: ml@example.com", "test.yml:2: invalid regex: '(outage'"},
+		{"invalid combination", "forward:\n  - all: {hashtag: incident}\n    to: ml@example.com", "test.yml:2: 'all' expects a list of matchers"},
+		{"unknown matcher", "forward:\n  - any: [{hashtags: incident}]\n    to: ml@example.com", "test.yml:2: unknown matcher: 'hashtags'"},
+		{"invalid strip", "forward:\n  - marker: ml\n    strip: yes\n    to: ml@example.com", "test.yml:3: 'strip' expects 'true' or 'false'"},
+		{"syntax error", "mail-host: [localhost", "test.yml: yaml: line 1"},
+	}
+
+	for _, test := range tests {
+		_, err := parseConfig("test.yml", []byte(test.content))
+		if err == nil {
+			t.Errorf("%s: no error was returned", test.name)
+			continue
+		}
+
+		if !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("%s: expected error not found - found: \"%s\", expected: \"%s\"", test.name, err.Error(), test.expected)
+		}
+	}
+}
+
+// settings from the command line should override the config file
+func TestApplyConfig(t *testing.T) {
+	origHost, origSubject := *mailHost, *mailSubject
+	defer func() {
+		*mailHost, *mailSubject = origHost, origSubject
+	}()
+
+	cfg, err := parseConfig("test.yml", []byte("mail-host: file-host:25\nmail-subject: file-subject\nmail-use-tls: yes-please"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// emulates the command line flag: '-mail-host cli-host:25'
+	flag.Set("mail-host", "cli-host:25")
+	explicitFlags["mail-host"] = true
+	defer delete(explicitFlags, "mail-host")
+
+	err = cfg.apply()
+	if err == nil || !strings.HasPrefix(err.Error(), "test.yml:3: invalid value for setting: 'mail-use-tls'") {
+		t.Errorf("expected error for the invalid 'mail-use-tls' value - received: %v", err)
+	}
+
+	if *mailHost != "cli-host:25" {
+		t.Errorf("command line flag should override the config file - mail-host: %s", *mailHost)
+	}
+	if *mailSubject != "file-subject" {
+		t.Errorf("setting from the config file not applied - mail-subject: %s", *mailSubject)
+	}
+}
+
+// the yaml config file must not be parsed from the flag package - it reads
+// the file of the reserved '-config' flag (and 'CONFIG') as key/value lines
+func TestConfigFileFlag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(file, []byte("mail-subject: file-subject\nforward:\n  - marker: ml\n    to: ml@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	origConfigFile := *configFile
+	defer func() {
+		*configFile = origConfigFile
+	}()
+
+	tests := []struct {
+		name string
+		args []string
+		env  string
+	}{
+		{"flag", []string{"-config-file", file}, ""},
+		{"environment", []string{}, file},
+	}
+
+	for _, test := range tests {
+		*configFile = ""
+		if test.env != "" {
+			os.Setenv("CONFIG_FILE", test.env)
+		}
+
+		// parse per the flags of the bot - with an error instead of an exit
+		flags := flag.NewFlagSet("matterbot", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		flag.VisitAll(func(f *flag.Flag) {
+			flags.Var(f.Value, f.Name, f.Usage)
+		})
+		err := flags.Parse(test.args)
+		os.Unsetenv("CONFIG_FILE")
+		if err != nil {
+			t.Errorf("%s: unable to parse the flags: %s", test.name, err.Error())
+			continue
+		}
+
+		if *configFile != file {
+			t.Errorf("%s: unexpected config file: '%s'", test.name, *configFile)
+			continue
+		}
+		if _, err := readConfig(*configFile); err != nil {
+			t.Errorf("%s: unable to read the config file: %s", test.name, err.Error())
+		}
+	}
+}
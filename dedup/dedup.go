@@ -0,0 +1,134 @@
+// Package dedup remembers which chat message was forwarded to which recipient.
+//
+// the entries are saved in a json file, so a message is forwarded only once
+// to each recipient - even across reconnects and restarts.
+//
+// the delivery is at-least-once: a message is remembered after the mail is
+// sent, so a crash between the send and 'Remember' still causes a duplicate.
+package dedup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// Store contains the forwarded messages per recipient
+type Store struct {
+	file string
+	ttl  time.Duration
+
+	// key: '<message-id>:<recipient>', value: forward timestamp
+	entries map[string]time.Time
+	mutex   sync.Mutex
+
+	// to control the time in unit-tests
+	now func() time.Time
+}
+
+// New opens the store in the given file - entries expire after the given ttl
+func New(file string, ttl time.Duration) (*Store, error) {
+	s := &Store{
+		file:    file,
+		ttl:     ttl,
+		entries: map[string]time.Time{},
+		now:     time.Now,
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		logger.Debugf("dedup file: %s not found - start with an empty store", file)
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read dedup file: %s", err.Error())
+	}
+
+	if err := json.Unmarshal(buf, &s.entries); err != nil {
+		return nil, fmt.Errorf("invalid dedup file: %s - error: %s", file, err.Error())
+	}
+
+	s.purge()
+	logger.Debugf("%d entries from dedup file: %s loaded", len(s.entries), file)
+	return s, nil
+}
+
+// Seen returns 'true' if the message was already forwarded to the recipient
+func (s *Store) Seen(msgID, recipient string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ts, found := s.entries[key(msgID, recipient)]
+	return found && s.now().Sub(ts) < s.ttl
+}
+
+// SeenAny returns 'true' if the message was already forwarded to any recipient
+func (s *Store) SeenAny(msgID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prefix := key(msgID, "")
+	for k, ts := range s.entries {
+		if strings.HasPrefix(k, prefix) && s.now().Sub(ts) < s.ttl {
+			return true
+		}
+	}
+	return false
+}
+
+// Remember saves that the message was forwarded to the recipients - the
+// file is written once for all recipients
+func (s *Store) Remember(msgID string, recipients ...string) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	for _, recipient := range recipients {
+		s.entries[key(msgID, recipient)] = now
+	}
+	s.purge()
+	return s.save()
+}
+
+// purge removes all expired entries
+func (s *Store) purge() {
+	for k, ts := range s.entries {
+		if s.now().Sub(ts) >= s.ttl {
+			delete(s.entries, k)
+		}
+	}
+}
+
+// save writes the store atomically - a crash never leaves a partial file
+func (s *Store) save() error {
+	buf, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.file); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	tmpFile := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.file)
+}
+
+func key(msgID, recipient string) string {
+	return msgID + ":" + recipient
+}
@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// remembered messages should survive a restart and expire after the ttl
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dedup.json")
+
+	s, err := New(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Seen("post-1", "ml@mail.com") {
+		t.Errorf("empty store should not contain any message")
+	}
+
+	if err := s.Remember("post-1", "ml@mail.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen - emulates a restart
+	if s, err = New(file, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Seen("post-1", "ml@mail.com") {
+		t.Errorf("message for 'ml@mail.com' should be remembered")
+	}
+	if s.Seen("post-1", "other@mail.com") {
+		t.Errorf("message for 'other@mail.com' should not be remembered")
+	}
+	if !s.SeenAny("post-1") || s.SeenAny("post") || s.SeenAny("post-2") {
+		t.Errorf("only 'post-1' should be remembered for any recipient")
+	}
+
+	// expired
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if s.Seen("post-1", "ml@mail.com") || s.SeenAny("post-1") {
+		t.Errorf("message should be expired")
+	}
+}
+
+// all recipients of a mail should be saved with one write - and nothing is
+// written without recipients
+func TestRememberRecipients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dedup.json")
+
+	s, err := New(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Remember("post-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected no dedup file without recipients, found: %v", err)
+	}
+
+	if err := s.Remember("post-1", "a@mail.com", "b@mail.com"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = New(file, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Seen("post-1", "a@mail.com") || !s.Seen("post-1", "b@mail.com") {
+		t.Errorf("both recipients should be remembered")
+	}
+}
@@ -3,65 +3,430 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
 	"strings"
-	"text/template"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/dedup"
 	"github.com/section77/matterbot/logger"
 	"github.com/section77/matterbot/mail"
+	"github.com/section77/matterbot/markdown"
+	"github.com/section77/matterbot/outbox"
 )
 
+// lastPostTs contains the create-timestamp of the last processed chat message.
+//
+// it survives a reconnect, so the messages which are posted while the bot
+// was disconnected can be backfilled.
+var lastPostTs int64
+
+// mailOutbox queues the mails which couldn't be delivered - it's 'nil' if disabled
+var mailOutbox *outbox.Outbox
+
+// sendCtx is used for all mail sends - it's canceled after the shutdown
+// deadline to abort the mail sends which are still in progress
+var sendCtx = context.Background()
+
+// forwarded remembers the forwarded messages per recipient - it's 'nil' if disabled
+var forwarded *dedup.Store
+
+// interval to check the outbox for mails to retry
+var outboxRetryInterval = 10 * time.Second
+
 // the dispatch function listens for new chat messages and forwards the messages
 // per mail if their start with a special marker
 //
-//   - dispatch block's until a error occurs
+//   - dispatch block's until a error occurs or the context is canceled
+//   - a canceled context stops taking new messages - a message which is in
+//     progress is forwarded before dispatch returns
 //   - if the message can't be fowarded to per mail, the mail-server error
 //     message are send as a reply to the original message in the chat-system
-func dispatch(chatServer chat.Server, mailServer mail.Server, fwdMappings []fwdMapping) error {
-	msgC, errC, err := chatServer.Listen()
+//     and the mail is queued in the outbox for later retries
+//   - after a reconnect, all messages since the last processed message - or
+//     since the first connect - are forwarded before the live messages
+//   - the forward config is loaded for each message, so a reload takes
+//     effect without interrupting the loop
+//   - messages are only forwarded from the configured teams and channels
+//   - edited or deleted messages are forwarded as corrections or
+//     retractions - if the original message was forwarded
+func dispatch(ctx context.Context, chatServer chat.Server, mailServer mail.Server, lc *liveConfig) error {
+	msgC, errC, err := chatServer.Listen(ctx)
 	if err != nil {
 		return err
 	}
 
+	// the team and channel names are resolved on each connect and after a reload
+	resolve := func(fc *forwardConfig) *resolvedScopes {
+		scopes, err := resolveScopes(chatServer, fc)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		return scopes
+	}
+	scopes := resolve(lc.load())
+	activeConfig := func() (*forwardConfig, *resolvedScopes) {
+		if fc := lc.load(); scopes.fc != fc {
+			scopes = resolve(fc)
+		}
+		return scopes.fc, scopes
+	}
+
+	// ids of the backfilled messages - the live channel can contain them too
+	backfilled := map[string]bool{}
+	if since := atomic.LoadInt64(&lastPostTs); since > 0 {
+		msgs, err := chatServer.PostsSince(since)
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("backfill %d messages which are posted while the bot was disconnected", len(msgs))
+		for _, msg := range msgs {
+			// direct messages can be listed once per team
+			if backfilled[msg.ID] {
+				continue
+			}
+			fc, scopes := activeConfig()
+			forwardMessage(chatServer, mailServer, fc, scopes, msg)
+			backfilled[msg.ID] = true
+		}
+	} else {
+		// seed the timestamp on the first connect - so the messages are
+		// backfilled even if the connection drops before any message is posted
+		rememberPostTs(connectTs(chatServer))
+	}
+
+	// retry the queued mails from the outbox periodically
+	var retryC <-chan time.Time
+	if mailOutbox != nil {
+		ticker := time.NewTicker(outboxRetryInterval)
+		defer ticker.Stop()
+		retryC = ticker.C
+	}
+
 	for {
 		logger.Info("observe chat for messages to forward")
 		select {
 		case msg := <-msgC:
-
-			if mappings, content, found := findFwdMappings(msg.Content, fwdMappings); found {
-				logger.Infof("%d marker found - chat-msg from: %s, in channel: %s - forward to each recipient",
-					len(mappings), msg.UserName, msg.ChannelName)
-
-				for _, m := range mappings {
-					logger.Infof("forward message with marker: '%s' to %s", m.marker, m.mailAddr)
-
-					// send the mail
-					if err = mailServer.Send(composeMessage(&msg, content, m.mailAddr), *mailUseTLS); err != nil {
-						logger.Errorf("unable to send mail - notify user in chat - mail error: %s", err.Error())
-						if err = chatServer.Send(&chat.Message{
-							ReplyToID:   msg.ID,
-							ChannelID:   msg.ChannelID,
-							ChannelName: msg.ChannelName,
-							Content:     "matterbot error: " + err.Error(),
-						}); err != nil {
-							logger.Errorf("unable to notify user about mail error - i give up - sorry! - chat error: %s",
-								err.Error())
-						}
-					} else {
-						logger.Debugf("mail to %s delivered", m.mailAddr)
-					}
-				}
-			} else {
-				logger.Debugf("ignore message from: '%s' - didn't contain any configured marker", msg.UserName)
+			if msg.Event != chat.Posted {
+				fc, _ := activeConfig()
+				forwardChange(chatServer, mailServer, fc, msg)
+				continue
 			}
+			if backfilled[msg.ID] {
+				logger.Debugf("ignore message from: '%s' - already backfilled", msg.UserName)
+				continue
+			}
+			fc, scopes := activeConfig()
+			forwardMessage(chatServer, mailServer, fc, scopes, msg)
+		case <-retryC:
+			retryOutbox(chatServer, mailServer)
 		case chatErr := <-errC:
 			return chatErr
+		case <-ctx.Done():
+			logger.Info("stop observing chat for messages to forward")
+			return nil
+		}
+	}
+}
+
+// forwardMessage forwards the given chat message per mail to each recipient
+// of the contained markers
+func forwardMessage(chatServer chat.Server, mailServer mail.Server, fc *forwardConfig, scopes *resolvedScopes, msg chat.Message) {
+	defer rememberPostTs(msg.CreateAt)
+
+	matches := fc.match(msg.Content)
+	if len(matches) == 0 {
+		logger.Debugf("ignore message from: '%s' - didn't match any forward rule", msg.UserName)
+		return
+	}
+
+	logger.Infof("%d forward rules match - chat-msg from: %s, in channel: %s - forward to each recipient",
+		len(matches), msg.UserName, msg.ChannelName)
+
+	// the sender is looked up on demand - only rules with a permission need it
+	var sender *chat.Sender
+	lookupSender := func() (*chat.Sender, error) {
+		var err error
+		if sender == nil {
+			sender, err = chatServer.Sender(&msg)
+		}
+		return sender, err
+	}
+	// the user is notified only once per rule
+	rejected := map[string]bool{}
+
+	groups := fwdGroups{}
+	for _, x := range matches {
+		m := x.fwdMapping
+		if !scopes.allows(&msg, m) {
+			logger.Infof("ignore rule: '%s' - not allowed in channel: %s", m.label(), msg.ChannelName)
+			continue
+		}
+		if m.opts != nil && m.opts.permission != nil && !senderPermitted(chatServer, &msg, m, lookupSender, rejected) {
+			continue
+		}
+		if forwarded != nil && forwarded.Seen(msg.ID, m.mailAddr) {
+			logger.Infof("skip message with rule: '%s' - already forwarded to %s", m.label(), m.mailAddr)
+			continue
+		}
+		logger.Infof("forward message with rule: '%s' to %s", m.label(), m.mailAddr)
+		groups.add(x)
+	}
+
+	if len(groups) == 0 {
+		return
+	}
+
+	// the files are downloaded only once for all recipients
+	files := loadAttachments(chatServer, &msg)
+	for _, g := range groups {
+		sendMail(chatServer, mailServer, &msg, composeMessage(&msg, g.content, g.mappings, fc, files))
+	}
+}
+
+// fwdGroup are the recipients which gets the same mail
+type fwdGroup struct {
+	content  string
+	mappings []fwdMapping
+}
+
+// fwdGroups groups the recipients per forward rule and content
+type fwdGroups []*fwdGroup
+
+// add adds the recipient to the group of its rule - the mappings from the 'forward'
+// flag are grouped per marker. a recipient gets only one mail.
+func (gs *fwdGroups) add(x fwdMatch) {
+	for _, g := range *gs {
+		for _, m := range g.mappings {
+			if m.mailAddr == x.mailAddr {
+				return
+			}
+		}
+	}
+
+	for _, g := range *gs {
+		m := g.mappings[0]
+		if g.content == x.content && m.opts == x.opts && (m.opts != nil || m.marker == x.marker) {
+			g.mappings = append(g.mappings, x.fwdMapping)
+			return
+		}
+	}
+	*gs = append(*gs, &fwdGroup{content: x.content, mappings: []fwdMapping{x.fwdMapping}})
+}
+
+// sendMail sends the mail for the given chat message.
+//
+// if the mail can't be send, the user is notified in the chat and the
+// mail is queued in the outbox (if enabled). if only some recipients are
+// rejected, the mail is queued for them - permanently rejected recipients
+// are only reported.
+func sendMail(chatServer chat.Server, mailServer mail.Server, msg *chat.Message, mailMsg *mail.Message) {
+	results, err := mailServer.Send(sendCtx, mailMsg, *mailUseTLS)
+	if err != nil {
+		logger.Errorf("unable to send mail - notify user in chat - mail error: %s", err.Error())
+		queueMail(chatServer, msg, mailMsg, err)
+		return
+	}
+
+	delivered, retry, retryErrs := []string{}, []string{}, []string{}
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			logger.Debugf("mail to %s delivered", r.Recipient)
+			delivered = append(delivered, r.Recipient)
+		case mail.IsPermanent(r.Err):
+			logger.Errorf("mail to %s rejected - notify user in chat - mail error: %s", r.Recipient, r.Err.Error())
+			notifyUser(chatServer, threadRootID(msg), msg.ChannelID, msg.ChannelName,
+				fmt.Sprintf("matterbot error: mail to %s rejected: %s", r.Recipient, r.Err.Error()))
+		default:
+			logger.Errorf("mail to %s deferred - notify user in chat - mail error: %s", r.Recipient, r.Err.Error())
+			retry = append(retry, r.Recipient)
+			retryErrs = append(retryErrs, r.Recipient+": "+r.Err.Error())
+		}
+	}
+	rememberForwarded(forwardedID(msg), delivered...)
+
+	if len(retry) > 0 {
+		queueMail(chatServer, msg, mailMsg.ForRecipients(retry), errors.New(strings.Join(retryErrs, ", ")))
+	}
+}
+
+// queueMail queues the undelivered mail in the outbox - the user is notified in the chat
+func queueMail(chatServer chat.Server, msg *chat.Message, mailMsg *mail.Message, err error) {
+	if mailOutbox == nil {
+		notifyUser(chatServer, threadRootID(msg), msg.ChannelID, msg.ChannelName, "matterbot error: "+err.Error())
+		return
+	}
+	// the outbox takes care of the delivery
+	rememberForwarded(forwardedID(msg), mailMsg.Recipients()...)
+
+	notifyUser(chatServer, threadRootID(msg), msg.ChannelID, msg.ChannelName,
+		"matterbot error: "+err.Error()+" - the mail is queued and will be retried")
+	entry := &outbox.Entry{
+		Mail:        mailMsg,
+		ReplyToID:   threadRootID(msg),
+		ChannelID:   msg.ChannelID,
+		ChannelName: msg.ChannelName,
+	}
+	dead, err := mailOutbox.Add(entry, err)
+	handleOutboxResult(chatServer, entry, dead, err)
+}
+
+// senderPermitted checks the permission of the rule. if the sender isn't
+// permitted, the reason is send as a reply to the original message - but
+// only once per rule ('rejected' contains the already rejected rules).
+func senderPermitted(chatServer chat.Server, msg *chat.Message, m fwdMapping,
+	lookupSender func() (*chat.Sender, error), rejected map[string]bool) bool {
+
+	sender, err := lookupSender()
+	if err != nil {
+		logger.Errorf("unable to lookup the permissions of: %s - error: %s", msg.UserName, err.Error())
+		if !rejected[m.label()] {
+			notifyUser(chatServer, threadRootID(msg), msg.ChannelID, msg.ChannelName,
+				fmt.Sprintf("matterbot error: unable to check your permission for: '%s'", m.label()))
+		}
+		rejected[m.label()] = true
+		return false
+	}
+
+	if m.opts.permission.allows(sender) {
+		return true
+	}
+
+	logger.Infof("reject rule: '%s' - sender: %s is not permitted", m.label(), msg.UserName)
+	if !rejected[m.label()] {
+		notifyUser(chatServer, threadRootID(msg), msg.ChannelID, msg.ChannelName, m.opts.permission.rejectReason(m.label()))
+	}
+	rejected[m.label()] = true
+	return false
+}
+
+// forwardedID returns the id which is remembered for the mail of the message -
+// the corrections are remembered per edit-timestamp
+func forwardedID(msg *chat.Message) string {
+	if msg.Event == chat.Edited {
+		return fmt.Sprintf("%s.edit.%d", msg.ID, msg.EditAt)
+	}
+	return msg.ID
+}
+
+// rememberForwarded saves that the message was forwarded to the given recipients
+func rememberForwarded(msgID string, recipients ...string) {
+	if forwarded == nil {
+		return
+	}
+
+	if err := forwarded.Remember(msgID, recipients...); err != nil {
+		logger.Errorf("unable to save the forwarded message in the dedup store - error: %s", err.Error())
+	}
+}
+
+// retryOutbox retries all due mails from the outbox
+func retryOutbox(chatServer chat.Server, mailServer mail.Server) {
+	entries, err := mailOutbox.Due(time.Now())
+	if err != nil {
+		logger.Errorf("unable to read the outbox - error: %s", err.Error())
+		return
+	}
+
+	for _, e := range entries {
+		recipients := strings.Join(e.Mail.Recipients(), ", ")
+		logger.Infof("retry queued mail to %s - attempt: %d", recipients, e.Attempts+1)
+		results, err := mailServer.Send(sendCtx, e.Mail, *mailUseTLS)
+		if err != nil {
+			logger.Errorf("unable to send queued mail - mail error: %s", err.Error())
+			dead, err := mailOutbox.Failed(e, err)
+			handleOutboxResult(chatServer, e, dead, err)
+			continue
+		}
+
+		// only the rejected recipients are retried again
+		rejected, errs := []string{}, []string{}
+		for _, r := range results {
+			if r.Err != nil {
+				rejected = append(rejected, r.Recipient)
+				errs = append(errs, r.Recipient+": "+r.Err.Error())
+			}
+		}
+		if len(rejected) > 0 {
+			logger.Errorf("queued mail rejected for: %s", strings.Join(errs, ", "))
+			e.Mail = e.Mail.ForRecipients(rejected)
+			dead, err := mailOutbox.Failed(e, errors.New(strings.Join(errs, ", ")))
+			handleOutboxResult(chatServer, e, dead, err)
+			continue
+		}
+
+		logger.Infof("queued mail to %s delivered", recipients)
+		if err := mailOutbox.Delivered(e); err != nil {
+			logger.Errorf("unable to remove delivered mail from the outbox - error: %s", err.Error())
+		}
+	}
+}
+
+// handleOutboxResult notifies the user in the thread of the original
+// message if the mail was given up
+func handleOutboxResult(chatServer chat.Server, e *outbox.Entry, dead bool, err error) {
+	if err != nil {
+		logger.Errorf("unable to update the outbox - error: %s", err.Error())
+	}
+
+	if dead {
+		notifyUser(chatServer, e.ReplyToID, e.ChannelID, e.ChannelName,
+			fmt.Sprintf("matterbot error: mail to %s given up after %d attempts - last error: %s",
+				strings.Join(e.Mail.Recipients(), ", "), e.Attempts, e.LastError))
+	}
+}
+
+// notifyUser sends the given message as a reply to the original message
+func notifyUser(chatServer chat.Server, replyToID, channelID, channelName, content string) {
+	if err := chatServer.Send(&chat.Message{
+		ReplyToID:   replyToID,
+		ChannelID:   channelID,
+		ChannelName: channelName,
+		Content:     content,
+	}); err != nil {
+		logger.Errorf("unable to notify user about mail error - i give up - sorry! - chat error: %s",
+			err.Error())
+	}
+}
+
+// threadRootID returns the id of the thread root - mattermost threads are flat,
+// so the replies to a reply are posted in the thread of the root
+func threadRootID(msg *chat.Message) string {
+	if msg.RootID != "" {
+		return msg.RootID
+	}
+	return msg.ID
+}
+
+// rememberPostTs saves the given create-timestamp if it's newer than the last one
+func rememberPostTs(ts int64) {
+	for {
+		last := atomic.LoadInt64(&lastPostTs)
+		if ts <= last || atomic.CompareAndSwapInt64(&lastPostTs, last, ts) {
+			return
 		}
 	}
 }
 
+// connectTs returns the current time of the chat-system - the local time if
+// it's not available
+func connectTs(chatServer chat.Server) int64 {
+	ts, err := chatServer.ServerTime()
+	if err != nil {
+		logger.Errorf("use the local time as connect time - %s", err.Error())
+		return time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	return ts
+}
+
 // find all mappings in the given content
 //
 // returns all found forward-mappings and the content with all markers removed
@@ -108,7 +473,12 @@ func findFwdMappings(content string, allFwdMappings []fwdMapping) ([]fwdMapping,
 //
 //   * meta-data are used from the given chat-message
 //   * mail-content are used from the given 'content' paramter
-func composeMessage(msg *chat.Message, content string, to string) *mail.Message {
+//   * the mappings are the recipients of the mail - from the same forward rule
+//   * the templates from the forward rule are preferred over the global templates
+//   * edited and deleted messages are threaded to the original message - see 'threadHeader'
+//   * the files are attached, or linked in the body - 'files' can be 'nil'
+//   * with a html template, the html and the text alternative are rendered from the markdown
+func composeMessage(msg *chat.Message, content string, ms []fwdMapping, fc *forwardConfig, files *attachments) *mail.Message {
 	type TemplateData struct {
 		User, Channel, Content string
 	}
@@ -118,29 +488,97 @@ func composeMessage(msg *chat.Message, content string, to string) *mail.Message
 		Content: content,
 	}
 
-	subject, err := execTemplate(mailSubjectTemplate, data)
+	// the options are the same for all mappings of a rule
+	m := ms[0]
+	subjectTemplate, bodyTemplate, htmlTemplate := fc.subjectTemplate, fc.bodyTemplate, fc.htmlTemplate
+	var toName string
+	if m.opts != nil {
+		toName = m.opts.name
+		if m.opts.subject != nil {
+			subjectTemplate = m.opts.subject
+		}
+		if m.opts.body != nil {
+			bodyTemplate = m.opts.body
+		}
+		if m.opts.html != nil {
+			htmlTemplate = m.opts.html
+		}
+	}
+
+	subject, err := execTemplate(subjectTemplate, data)
 	if err != nil {
 		logger.Error(err.Error())
 		subject = err.Error()
 	}
 
-	body, err := execTemplate(mailBodyTemplate, data)
+	// in html mails, the text alternative is rendered from the markdown
+	if htmlTemplate != nil {
+		data.Content = markdown.ToText(content)
+	}
+
+	body, err := execTemplate(bodyTemplate, data)
 	if err != nil {
 		logger.Error(err.Error())
 		body = err.Error()
 	}
 
-	// time format (https://tools.ietf.org/html/rfc5322#section-3.3)
-	tsFmt := "Mon, 02 Jan 2006 15:04:05 MST"
-	return mail.ComposeMessage(mail.Header{
+	var htmlBody string
+	if htmlTemplate != nil {
+		htmlBody, err = execTemplate(htmlTemplate, struct {
+			User, Channel string
+			Content       htmltemplate.HTML
+		}{msg.UserName, msg.ChannelName, htmltemplate.HTML(markdown.ToHTML(content))})
+		if err != nil {
+			logger.Error(err.Error())
+			htmlBody = htmltemplate.HTMLEscapeString(err.Error())
+		}
+	}
+
+	switch msg.Event {
+	case chat.Edited:
+		subject = "[correction] " + subject
+	case chat.Deleted:
+		subject = "[retracted] " + subject
+		body = fmt.Sprintf("%s has deleted the message in channel: %s - please disregard it.",
+			msg.UserName, msg.ChannelName)
+		htmlBody = "<p>" + htmltemplate.HTMLEscapeString(body) + "</p>"
+	}
+
+	header := mail.Header{
 		From:      *mailUser,
-		To:        to,
+		FromName:  *mailFromName,
+		ReplyTo:   replyToAddress(msg.ID),
 		Subject:   subject,
-		Timestamp: time.Now().Format(tsFmt),
-	}, body)
+		Timestamp: time.Now().Format(mail.DateFormat),
+	}
+	for _, m := range ms {
+		addr := mail.Address{Name: toName, Address: m.mailAddr}
+		switch m.rcpt {
+		case rcptCc:
+			header.Cc = append(header.Cc, addr)
+		case rcptBcc:
+			header.Bcc = append(header.Bcc, addr)
+		default:
+			header.To = append(header.To, addr)
+		}
+	}
+	threadHeader(&header, msg)
+
+	if files == nil {
+		files = &attachments{}
+	}
+	if htmlTemplate == nil {
+		return mail.ComposeMessage(header, body+files.linkList(), files.files...)
+	}
+	return mail.ComposeHTMLMessage(header, body+files.linkList(), htmlBody+files.linkListHTML(), files.files...)
+}
+
+// templateExecutor is a 'text/template' or a 'html/template'
+type templateExecutor interface {
+	Execute(io.Writer, interface{}) error
 }
 
-func execTemplate(template *template.Template, data interface{}) (string, error) {
+func execTemplate(template templateExecutor, data interface{}) (string, error) {
 	var buf bytes.Buffer
 
 	writer := bufio.NewWriter(&buf)
@@ -1,22 +1,60 @@
 package main
 
 import (
+	"context"
 	"errors"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/dedup"
 	"github.com/section77/matterbot/mail"
+	"github.com/section77/matterbot/outbox"
 )
 
+// testConfig returns a forward config with the given mappings and the default templates
+func testConfig(fwdMappings ...fwdMapping) *liveConfig {
+	return newLiveConfig(&forwardConfig{
+		fwdMappings:     fwdMappings,
+		subjectTemplate: template.Must(template.New("mail-subject").Parse(*mailSubject)),
+		bodyTemplate:    template.Must(template.New("mail-body").Parse(*mailBody)),
+	})
+}
+
+// startDispatch runs the dispatcher in the background - the returned function
+// stops the dispatcher and waits until it's finished, so the tests can reset
+// the global state afterwards
+func startDispatch(chatServer chat.Server, mailServer mail.Server, lc *liveConfig) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		dispatch(ctx, chatServer, mailServer, lc)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
 func TestFindFwdMappings(t *testing.T) {
 	expectedMappings := []fwdMapping{
-		fwdMapping{"user1", "user1@mail.com"},
-		fwdMapping{"user2", "user2@mail.com"},
+		fwdMapping{marker: "user1", mailAddr: "user1@mail.com"},
+		fwdMapping{marker: "user2", mailAddr: "user2@mail.com"},
 	}
 	expectedContent := "test message"
-	mappings, content, found := findMappings("@user1, @xx @user2 "+expectedContent, expectedMappings)
+	mappings, content, found := findFwdMappings("@user1, @xx @user2 "+expectedContent, expectedMappings)
 
 	// found should be true
 	if !found {
@@ -41,9 +79,9 @@ func TestDispatchSendMessagesOnlyWithMarker(t *testing.T) {
 	chatMock := chat.NewMock()
 	mailMock := mail.NewMock()
 
-	go dispatch(chatMock, mailMock, []fwdMapping{
-		fwdMapping{"ml", "ml@mail.com"},
-	})
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+	))
 
 	tests := []struct {
 		content              string
@@ -67,15 +105,15 @@ func TestDispatchSendMessagesOnlyWithMarker(t *testing.T) {
 		})
 	}
 
-	if len(mailMock.Messages) != expectedMessagesCount {
+	if len(mailMock.Messages()) != expectedMessagesCount {
 		t.Errorf("expected %d mail messages, but found: %d messages",
-			expectedMessagesCount, len(mailMock.Messages))
+			expectedMessagesCount, len(mailMock.Messages()))
 	}
 
 	var n int
 	for _, test := range tests {
 		if test.msgShouldBeForwarded {
-			content := mailMock.Messages[n].Content
+			content := mailMock.Messages()[n].Content
 			if strings.HasSuffix(content, test.content) {
 				t.Errorf("mail content from the %d. mail should end with '%s', but ends with '%s'",
 					n+1, test.content, content)
@@ -90,23 +128,23 @@ func TestDispatcherSendsMailToAllRecipients(t *testing.T) {
 	chatMock := chat.NewMock()
 	mailMock := mail.NewMock()
 
-	go dispatch(chatMock, mailMock, []fwdMapping{
-		fwdMapping{"user1", "user1@mail.com"},
-		fwdMapping{"user2", "user2@mail.com"},
-	})
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "user1", mailAddr: "user1@mail.com"},
+		fwdMapping{marker: "user2", mailAddr: "user2@mail.com"},
+	))
 
 	// one receiver
 	chatMock.TriggerMsgEvent(chat.Message{
 		Content: " @user1 hey",
 	})
-	verifyDispatchSendsMailToAllRecipients("one receiver", mailMock.Messages, []string{"user1@mail.com"}, t)
+	verifyDispatchSendsMailToAllRecipients("one receiver", mailMock.Messages(), []string{"user1@mail.com"}, t)
 	mailMock.ClearMessages()
 
 	// two receiver
 	chatMock.TriggerMsgEvent(chat.Message{
 		Content: "@user1,@user2 hey",
 	})
-	verifyDispatchSendsMailToAllRecipients("two receivers", mailMock.Messages, []string{"user1@mail.com", "user2@mail.com"}, t)
+	verifyDispatchSendsMailToAllRecipients("two receivers", mailMock.Messages(), []string{"user1@mail.com", "user2@mail.com"}, t)
 	mailMock.ClearMessages()
 }
 
@@ -117,12 +155,382 @@ func verifyDispatchSendsMailToAllRecipients(name string, msgs []*mail.Message, e
 	}
 
 	for i, msg := range msgs {
-		if !strings.HasPrefix(msg.Header.To, expectedRecipients[i]) {
+		if !strings.HasPrefix(msg.Header.To.String(), expectedRecipients[i]) {
 			t.Errorf("%s: expected recipent: %s, found: %s", name, expectedRecipients[i], msg.Header.To)
 		}
 	}
 }
 
+// after a reconnect, the messages which are posted while the bot was
+// disconnected should be forwarded - but only once
+func TestDispatchBackfillsMissedMessages(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	atomic.StoreInt64(&lastPostTs, 100)
+	defer atomic.StoreInt64(&lastPostTs, 0)
+
+	chatMock.Backlog = []chat.Message{
+		chat.Message{ID: "1", Content: "@ml already forwarded", CreateAt: 90},
+		chat.Message{ID: "2", Content: "@ml missed while disconnected", CreateAt: 110},
+		chat.Message{ID: "3", Content: "without marker", CreateAt: 120},
+		// a direct message is in no team - it's listed in each team of the bot
+		chat.Message{ID: "dm", ChannelID: "bot__user", Content: "@ml direct message", CreateAt: 125},
+		chat.Message{ID: "dm", ChannelID: "bot__user", Content: "@ml direct message", CreateAt: 125},
+	}
+
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+	))
+
+	// the live channel delivers a backfilled message again
+	chatMock.TriggerMsgEvent(chat.Message{ID: "2", Content: "@ml missed while disconnected", CreateAt: 110})
+	chatMock.TriggerMsgEvent(chat.Message{ID: "4", Content: "@ml live message", CreateAt: 130})
+
+	if len(mailMock.Messages()) != 3 {
+		t.Fatalf("expected 3 mail messages, but found: %d messages", len(mailMock.Messages()))
+	}
+
+	for i, expected := range []string{"missed while disconnected", "direct message", "live message"} {
+		if content := mailMock.Messages()[i].Content; content != expected {
+			t.Errorf("unexpected content in the %d. mail: '%s', expected: '%s'", i+1, content, expected)
+		}
+	}
+
+	if ts := atomic.LoadInt64(&lastPostTs); ts != 130 {
+		t.Errorf("expected last post timestamp: 130, found: %d", ts)
+	}
+}
+
+// if the connection drops before any message is posted, the messages since
+// the first connect should be backfilled
+func TestDispatchBackfillsMessagesSinceTheFirstConnect(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	atomic.StoreInt64(&lastPostTs, 0)
+	defer atomic.StoreInt64(&lastPostTs, 0)
+
+	chatMock.Time = 100
+	chatMock.Backlog = []chat.Message{
+		chat.Message{ID: "1", Content: "@ml posted before the first connect", CreateAt: 90},
+		chat.Message{ID: "2", Content: "@ml missed while disconnected", CreateAt: 110},
+	}
+	lc := testConfig(fwdMapping{marker: "ml", mailAddr: "ml@mail.com"})
+
+	// the connection drops before any message is posted
+	chatMock.TriggerErrorEvent(errors.New("disconnected"))
+	if err := dispatch(context.Background(), chatMock, mailMock, lc); err == nil {
+		t.Fatal("expected the disconnect error")
+	}
+	if ts := atomic.LoadInt64(&lastPostTs); ts != 100 {
+		t.Fatalf("expected the connect time: 100 as last post timestamp, found: %d", ts)
+	}
+	if len(mailMock.Messages()) != 0 {
+		t.Fatalf("expected no mail on the first connect, but found: %d messages", len(mailMock.Messages()))
+	}
+
+	stop := startDispatch(chatMock, mailMock, lc)
+	defer stop()
+	time.Sleep(100 * time.Millisecond)
+
+	if len(mailMock.Messages()) != 1 {
+		t.Fatalf("expected 1 mail message, but found: %d messages", len(mailMock.Messages()))
+	}
+	if content := mailMock.Messages()[0].Content; content != "missed while disconnected" {
+		t.Errorf("unexpected content: '%s'", content)
+	}
+}
+
+// mails which couldn't be delivered should be retried from the outbox, and
+// the user should be notified if the mail is given up
+func TestDispatcherRetriesMailsFromOutbox(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	dir, err := ioutil.TempDir("", "matterbot-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if mailOutbox, err = outbox.New(dir, 2, 150*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	outboxRetryInterval = 20 * time.Millisecond
+	defer func() {
+		mailOutbox = nil
+		outboxRetryInterval = 10 * time.Second
+	}()
+
+	stop := startDispatch(chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+	))
+	// stop the dispatcher before the outbox is disabled
+	defer stop()
+
+	mailMock.SetMailServerError(errors.New("mail-mock-test-error"))
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-id", Content: "@ml dummy message"})
+
+	// first: 'queued' notification, after the retry: 'given up' notification
+	time.Sleep(300 * time.Millisecond)
+	if len(chatMock.Messages()) != 2 {
+		t.Fatalf("expected two messages in chat-mock, actual message count in chat-mock: %d", len(chatMock.Messages()))
+	}
+
+	for i, expected := range []string{"queued", "given up after 2 attempts"} {
+		if msg := chatMock.Messages()[i]; !strings.Contains(msg.Content, expected) || msg.ReplyToID != "post-id" {
+			t.Errorf("%d. chat message should contain '%s' as a reply to 'post-id' - found: %+v", i+1, expected, msg)
+		}
+	}
+
+	// a recovered mail-server should deliver the queued mail
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-id-2", Content: "@ml second message"})
+	mailMock.SetMailServerError(nil)
+	time.Sleep(300 * time.Millisecond)
+
+	if len(mailMock.Messages()) != 1 || mailMock.Messages()[0].Content != "second message" {
+		t.Errorf("expected the delivery of the queued mail - delivered: %+v", mailMock.Messages())
+	}
+}
+
+// a message should be forwarded at most once to each recipient
+func TestDispatcherForwardsMessagesOnlyOnce(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	dir, err := ioutil.TempDir("", "matterbot-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if forwarded, err = dedup.New(filepath.Join(dir, "dedup.json"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := startDispatch(chatMock, mailMock, testConfig(
+		fwdMapping{marker: "user1", mailAddr: "user1@mail.com"},
+		fwdMapping{marker: "user2", mailAddr: "user2@mail.com"},
+	))
+	// stop the dispatcher before the dedup store is disabled
+	defer func() {
+		stop()
+		forwarded = nil
+	}()
+
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", Content: "@user1 hey"})
+	// same message - but with an additional recipient
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-1", Content: "@user1 @user2 hey"})
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-2", Content: "@user1 hey"})
+
+	verifyDispatchSendsMailToAllRecipients("forward only once", mailMock.Messages(),
+		[]string{"user1@mail.com", "user2@mail.com", "user1@mail.com"}, t)
+}
+
+// a canceled context should stop 'dispatch' - but only after
+// the mail send in progress is finished
+func TestDispatchStopsOnCanceledContext(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+	mailMock.SendDelay = 300 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error)
+	go func() {
+		errC <- dispatch(ctx, chatMock, mailMock, testConfig(
+			fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+		))
+	}()
+
+	// the mail send is in progress when the context is canceled
+	chatMock.TriggerMsgEvent(chat.Message{Content: "@ml in progress"})
+	cancel()
+
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("'dispatch' didn't stop")
+	}
+
+	if len(mailMock.Messages()) != 1 {
+		t.Errorf("mail send in progress should be finished - delivered mails: %d", len(mailMock.Messages()))
+	}
+}
+
+// only permitted senders should forward messages with a restricted marker - the
+// other senders should get a reply with the reason
+func TestDispatcherChecksSenderPermission(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	chatMock.Senders = map[string]*chat.Sender{
+		"alice-id": &chat.Sender{UserName: "alice"},
+		"bob-id":   &chat.Sender{UserName: "bob", Roles: []string{"system_user", "channel_admin"}},
+		"carol-id": &chat.Sender{UserName: "carol", Groups: []string{"board"}},
+		"dave-id":  &chat.Sender{UserName: "dave", Roles: []string{"system_user"}, Groups: []string{"members"}},
+	}
+
+	opts := &fwdOptions{permission: newPermission([]string{"alice"}, []string{"board"}, []string{"channel_admin"})}
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com", opts: opts},
+		fwdMapping{marker: "ml", mailAddr: "archive@mail.com", opts: opts},
+	))
+
+	for _, user := range []string{"alice", "bob", "carol", "dave"} {
+		chatMock.TriggerMsgEvent(chat.Message{
+			ID:       user + "-post",
+			UserID:   user + "-id",
+			UserName: user,
+			Content:  "@ml hey",
+		})
+	}
+
+	// one mail per rule with both recipients
+	if len(mailMock.Messages()) != 3 {
+		t.Errorf("expected 3 mail messages from alice, bob and carol - found: %d", len(mailMock.Messages()))
+	}
+	for _, msg := range mailMock.Messages() {
+		if msg.Header.To.String() != "ml@mail.com, archive@mail.com" {
+			t.Errorf("unexpected recipients: %s", msg.Header.To)
+		}
+	}
+
+	// one reply for both mail addresses
+	if len(chatMock.Messages()) != 1 {
+		t.Fatalf("expected one reply to dave, found: %d", len(chatMock.Messages()))
+	}
+	if reply := chatMock.Messages()[0]; reply.ReplyToID != "dave-post" || !strings.Contains(reply.Content, "not allowed") {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+}
+
+// the rejection of a reply inside a thread should be posted in the thread of the root
+func TestDispatcherRejectsReplyInThread(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	chatMock.Senders = map[string]*chat.Sender{
+		"dave-id": &chat.Sender{UserName: "dave", Roles: []string{"system_user"}},
+	}
+
+	opts := &fwdOptions{permission: newPermission([]string{"alice"}, nil, nil)}
+	stop := startDispatch(chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com", opts: opts},
+	))
+	defer stop()
+
+	chatMock.TriggerMsgEvent(chat.Message{
+		ID:       "dave-reply",
+		RootID:   "root-post",
+		UserID:   "dave-id",
+		UserName: "dave",
+		Content:  "@ml hey",
+	})
+
+	if len(mailMock.Messages()) != 0 {
+		t.Errorf("expected no mail message, found: %d", len(mailMock.Messages()))
+	}
+	if len(chatMock.Messages()) != 1 {
+		t.Fatalf("expected one reply to dave, found: %d", len(chatMock.Messages()))
+	}
+	if reply := chatMock.Messages()[0]; reply.ReplyToID != "root-post" || !strings.Contains(reply.Content, "not allowed") {
+		t.Errorf("expected the reply in the thread of 'root-post', found: %+v", reply)
+	}
+}
+
+// the recipients of a rule should get one mail - a rejected recipient should be
+// reported without failing the others
+func TestDispatchSendsOneMailPerRule(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+	mailMock.Rejected = map[string]error{
+		"gone@mail.com": &textproto.Error{Code: 550, Msg: "no such user"},
+	}
+
+	opts := &fwdOptions{name: "List"}
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com", opts: opts},
+		fwdMapping{marker: "ml", mailAddr: "board@mail.com", rcpt: rcptCc, opts: opts},
+		fwdMapping{marker: "ml", mailAddr: "gone@mail.com", rcpt: rcptCc, opts: opts},
+		fwdMapping{marker: "ml", mailAddr: "archive@mail.com", rcpt: rcptBcc, opts: opts},
+	))
+	defer chatMock.TriggerErrorEvent(errors.New("stop"))
+
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-id", Content: "@ml hey"})
+
+	if len(mailMock.Messages()) != 1 {
+		t.Fatalf("expected one mail for the rule - found: %d", len(mailMock.Messages()))
+	}
+	msg := mailMock.Messages()[0]
+	if msg.Header.To.String() != "ml@mail.com" || msg.Header.Cc.String() != "board@mail.com, gone@mail.com" ||
+		msg.Header.Bcc.String() != "archive@mail.com" {
+		t.Errorf("unexpected recipients: %+v", msg.Header)
+	}
+	if strings.Contains(msg.Body, "archive@mail.com") {
+		t.Errorf("the 'Bcc' recipient shouldn't be in the mail: %s", msg.Body)
+	}
+
+	if len(chatMock.Messages()) != 1 {
+		t.Fatalf("expected one notification for the rejected recipient, found: %d", len(chatMock.Messages()))
+	}
+	if reply := chatMock.Messages()[0]; reply.ReplyToID != "post-id" || !strings.Contains(reply.Content, "gone@mail.com") ||
+		!strings.Contains(reply.Content, "no such user") {
+		t.Errorf("unexpected notification: %+v", reply)
+	}
+}
+
+// a temporary rejected recipient should be retried from the outbox - without
+// the other recipients
+func TestDispatchQueuesTemporaryRejectedRecipients(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+	mailMock.Rejected = map[string]error{
+		"busy@mail.com": &textproto.Error{Code: 451, Msg: "try again later"},
+	}
+
+	dir, err := ioutil.TempDir("", "matterbot-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if mailOutbox, err = outbox.New(dir, 3, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	outboxRetryInterval = 20 * time.Millisecond
+	defer func() {
+		mailOutbox = nil
+		outboxRetryInterval = 10 * time.Second
+	}()
+
+	stop := startDispatch(chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+		fwdMapping{marker: "ml", mailAddr: "busy@mail.com"},
+	))
+	// stop the dispatcher before the outbox is disabled
+	defer stop()
+
+	chatMock.TriggerMsgEvent(chat.Message{ID: "post-id", Content: "@ml hey"})
+	if len(chatMock.Messages()) != 1 || !strings.Contains(chatMock.Messages()[0].Content, "queued") {
+		t.Fatalf("expected a 'queued' notification, found: %+v", chatMock.Messages())
+	}
+
+	// the recovered recipient should get the queued mail
+	mailMock.SetRejected(nil)
+	time.Sleep(200 * time.Millisecond)
+
+	if len(mailMock.Messages()) != 2 {
+		t.Fatalf("expected the delivery of the queued mail - delivered: %d", len(mailMock.Messages()))
+	}
+	if to := mailMock.Messages()[1].Header.To.String(); to != "busy@mail.com" {
+		t.Errorf("the queued mail should be only for the rejected recipient - found: %s", to)
+	}
+}
+
 // the call on 'dispatch' should block, and only returns
 // if a error occurs
 func TestDispatchBlocksAndReturnsTheError(t *testing.T) {
@@ -135,7 +543,7 @@ func TestDispatchBlocksAndReturnsTheError(t *testing.T) {
 	}()
 
 	blockingStartTs := time.Now()
-	err := dispatch(chatMock, mailMock, []fwdMapping{})
+	err := dispatch(context.Background(), chatMock, mailMock, testConfig())
 
 	if time.Since(blockingStartTs) < 400*time.Millisecond {
 		t.Errorf("'dispatch' call didn't block")
@@ -152,9 +560,9 @@ func TestDispatcherSendsChatMsgOnMailError(t *testing.T) {
 	chatMock := chat.NewMock()
 	mailMock := mail.NewMock()
 
-	go dispatch(chatMock, mailMock, []fwdMapping{
-		fwdMapping{"ml", "ml@mail.com"},
-	})
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+	))
 
 	dummyMsg := chat.Message{
 		Content: "@ml dummy message",
@@ -166,7 +574,7 @@ func TestDispatcherSendsChatMsgOnMailError(t *testing.T) {
 	//   - the bot should not msgs any chat messages
 	//
 	chatMock.TriggerMsgEvent(dummyMsg)
-	if len(chatMock.Messages) != 0 {
+	if len(chatMock.Messages()) != 0 {
 		t.Error("expected empty chat-message queue")
 	}
 
@@ -178,11 +586,56 @@ func TestDispatcherSendsChatMsgOnMailError(t *testing.T) {
 	//
 	mailMock.SetMailServerError(errors.New("mail-mock-test-error"))
 	chatMock.TriggerMsgEvent(dummyMsg)
-	if len(chatMock.Messages) != 1 {
-		t.Errorf("expected one message in chat-mock, actual message count in chat-mock: %d", len(chatMock.Messages))
+	if len(chatMock.Messages()) != 1 {
+		t.Errorf("expected one message in chat-mock, actual message count in chat-mock: %d", len(chatMock.Messages()))
 	}
 
-	if !strings.Contains(chatMock.Messages[0].Content, "mail-mock-test-error") {
+	if !strings.Contains(chatMock.Messages()[0].Content, "mail-mock-test-error") {
 		t.Errorf("expected message in chat-mock not found")
 	}
 }
+
+// html mails should contain the sanitized html and a readable text alternative
+func TestDispatchSendsHTMLMails(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	cfg := testConfig(fwdMapping{marker: "ml", mailAddr: "ml@mail.com"})
+	cfg.load().htmlTemplate = htmltemplate.Must(htmltemplate.New("mail-html-template").Parse(*mailHTMLTemplate))
+	go dispatch(context.Background(), chatMock, mailMock, cfg)
+
+	chatMock.TriggerMsgEvent(chat.Message{
+		Content: "@ml **important**: see [the docs](https://example.com) <script>alert(1)</script>",
+	})
+
+	if len(mailMock.Messages()) != 1 {
+		t.Fatalf("expected one mail - found: %d", len(mailMock.Messages()))
+	}
+
+	parsed, err := netmail.ReadMessage(strings.NewReader(mailMock.Messages()[0].Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content-type: %s", parsed.Header.Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, expected := range []string{
+		"important: see the docs (https://example.com) alert(1)",
+		`<p><strong>important</strong>: see <a href="https://example.com" rel="nofollow">the docs</a> alert(1)</p>`,
+	} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(content)) != expected {
+			t.Errorf("part: '%s' - expected: %q, found: %q", part.Header.Get("Content-Type"), expected, content)
+		}
+	}
+}
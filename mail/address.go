@@ -0,0 +1,35 @@
+package mail
+
+import "strings"
+
+// Address is a mail address with an optional display name
+type Address struct {
+	Name    string
+	Address string
+}
+
+// AddressList is a list of mail addresses - like the recipients in 'To'
+type AddressList []Address
+
+// Addresses returns the mail addresses without the display names
+func (l AddressList) Addresses() []string {
+	addrs := []string{}
+	for _, a := range l {
+		addrs = append(addrs, a.Address)
+	}
+	return addrs
+}
+
+// String returns the mail addresses without the display names - for logs
+func (l AddressList) String() string {
+	return strings.Join(l.Addresses(), ", ")
+}
+
+// format returns the addresses for the mail header - the display names are encoded
+func (l AddressList) format() string {
+	xs := []string{}
+	for _, a := range l {
+		xs = append(xs, formatAddress(a.Name, a.Address))
+	}
+	return strings.Join(xs, ", ")
+}
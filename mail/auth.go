@@ -0,0 +1,175 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// authentication mechanisms for 'Auth.Mechanism'
+const (
+	AuthAuto    = "auto"
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	AuthXOAuth2 = "xoauth2"
+	AuthNone    = "none"
+)
+
+// Auth are the settings for the smtp authentication
+type Auth struct {
+	// one of the 'Auth*' mechanisms - 'AuthAuto' if empty
+	Mechanism string
+
+	User string
+	Pass string
+
+	// the access token for 'xoauth2' - with 'AuthAuto' only used if it's set
+	Token TokenSource
+}
+
+// Validate checks the mechanism
+func (a Auth) Validate() error {
+	switch a.mechanism() {
+	case AuthAuto, AuthPlain, AuthLogin, AuthCRAMMD5, AuthNone:
+		return nil
+	case AuthXOAuth2:
+		if a.Token == nil {
+			return errors.New("auth mechanism 'xoauth2' needs a token source")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown auth mechanism: '%s' - expected one of: auto, plain, login, cram-md5, xoauth2 or none", a.Mechanism)
+}
+
+func (a Auth) mechanism() string {
+	if a.Mechanism == "" {
+		return AuthAuto
+	}
+	return strings.ToLower(a.Mechanism)
+}
+
+// authenticate authenticates the session with the configured mechanism. with
+// 'AuthAuto' the mechanism is chosen from the 'AUTH' extension of the server - a
+// server without the extension is used without authentication.
+func (a Auth) authenticate(ctx context.Context, client *smtp.Client, host string) error {
+	mechanism := a.mechanism()
+	if mechanism == AuthAuto {
+		ok, params := client.Extension("AUTH")
+		if !ok {
+			return nil
+		}
+		mechanism = a.negotiate(params)
+		if mechanism == "" {
+			return fmt.Errorf("no supported auth mechanism - the server offers: %s", params)
+		}
+	}
+
+	var auth smtp.Auth
+	switch mechanism {
+	case AuthNone:
+		return nil
+	case AuthPlain:
+		auth = smtp.PlainAuth("", a.User, a.Pass, host)
+	case AuthLogin:
+		auth = &loginAuth{user: a.User, pass: a.Pass, host: host}
+	case AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(a.User, a.Pass)
+	case AuthXOAuth2:
+		token, err := a.Token.Token(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to get the access token - %s", err.Error())
+		}
+		auth = &xoauth2Auth{user: a.User, token: token, host: host}
+	}
+	return client.Auth(auth)
+}
+
+// negotiate returns the preferred mechanism from the offered mechanisms - empty if
+// none is supported. 'xoauth2' is only preferred with a token source.
+func (a Auth) negotiate(offered string) string {
+	supported := map[string]bool{}
+	for _, m := range strings.Fields(offered) {
+		supported[strings.ToLower(m)] = true
+	}
+
+	preferred := []string{AuthPlain, AuthLogin, AuthCRAMMD5}
+	if a.Token != nil {
+		preferred = append([]string{AuthXOAuth2}, preferred...)
+	}
+	for _, m := range preferred {
+		if supported[m] {
+			return m
+		}
+	}
+	return ""
+}
+
+// checkEncrypted rejects an unencrypted connection to a remote server - like
+// 'smtp.PlainAuth', the credentials are sent in clear text
+func checkEncrypted(server *smtp.ServerInfo, host string) error {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return errors.New("unencrypted connection")
+	}
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	return nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// loginAuth implements the 'LOGIN' mechanism - the server asks for
+// the user and the password
+type loginAuth struct {
+	user, pass, host string
+	step             int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkEncrypted(server, a.host); err != nil {
+		return "", nil, err
+	}
+	a.step = 0
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.user), nil
+	case 2:
+		return []byte(a.pass), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+}
+
+// xoauth2Auth implements the 'XOAUTH2' mechanism - with a bearer token
+type xoauth2Auth struct {
+	user, token, host string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkEncrypted(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the error details are sent as challenge - the empty response
+		// completes the exchange, and the server rejects the login
+		return []byte{}, nil
+	}
+	return nil, nil
+}
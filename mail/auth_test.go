@@ -0,0 +1,174 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type staticToken string
+
+func (t staticToken) Token(ctx context.Context) (string, error) {
+	return string(t), nil
+}
+
+func TestNegotiateAuthMechanism(t *testing.T) {
+	tests := []struct {
+		offered  string
+		token    TokenSource
+		expected string
+	}{
+		{"PLAIN LOGIN", nil, AuthPlain},
+		{"LOGIN CRAM-MD5", nil, AuthLogin},
+		{"cram-md5", nil, AuthCRAMMD5},
+		{"XOAUTH2 PLAIN", nil, AuthPlain},
+		{"XOAUTH2 PLAIN", staticToken("token"), AuthXOAuth2},
+		{"XOAUTH2", nil, ""},
+		{"GSSAPI", nil, ""},
+	}
+
+	for _, test := range tests {
+		if m := (Auth{Token: test.token}).negotiate(test.offered); m != test.expected {
+			t.Errorf("offered: '%s' - expected: '%s', found: '%s'", test.offered, test.expected, m)
+		}
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	tests := []struct {
+		auth  Auth
+		valid bool
+	}{
+		{Auth{}, true},
+		{Auth{Mechanism: "LOGIN"}, true},
+		{Auth{Mechanism: "none"}, true},
+		{Auth{Mechanism: "xoauth2"}, false},
+		{Auth{Mechanism: "xoauth2", Token: staticToken("token")}, true},
+		{Auth{Mechanism: "digest-md5"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.auth.Validate(); (err == nil) != test.valid {
+			t.Errorf("mechanism: '%s' - expected valid: %v, error: %v", test.auth.Mechanism, test.valid, err)
+		}
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	auth := &loginAuth{user: "user", pass: "secret", host: "mail.example.com"}
+
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com"}); err == nil {
+		t.Errorf("the credentials shouldn't be sent over an unencrypted connection")
+	}
+
+	mechanism, resp, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+	if err != nil || mechanism != "LOGIN" || resp != nil {
+		t.Fatalf("unexpected start: %s, %q, %v", mechanism, resp, err)
+	}
+	for _, expected := range []string{"user", "secret"} {
+		if resp, err := auth.Next([]byte("challenge"), true); err != nil || string(resp) != expected {
+			t.Errorf("expected: '%s', found: '%s' (%v)", expected, resp, err)
+		}
+	}
+	if _, err := auth.Next([]byte("challenge"), true); err == nil {
+		t.Errorf("expected an error for the third challenge")
+	}
+}
+
+func TestXOAuth2Auth(t *testing.T) {
+	auth := &xoauth2Auth{user: "user@example.com", token: "token", host: "mail.example.com"}
+
+	mechanism, resp, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+	if err != nil || mechanism != "XOAUTH2" || string(resp) != "user=user@example.com\x01auth=Bearer token\x01\x01" {
+		t.Fatalf("unexpected start: %s, %q, %v", mechanism, resp, err)
+	}
+
+	// the error challenge is answered with an empty response
+	if resp, err := auth.Next([]byte(`{"status":"401"}`), true); err != nil || len(resp) != 0 {
+		t.Errorf("unexpected response: %q, %v", resp, err)
+	}
+}
+
+// a forced mechanism should fail on a server without authentication
+func TestSendWithForcedAuth(t *testing.T) {
+	addr, _, received, stop := startTestReceiver(t)
+	defer stop()
+
+	server := New(addr, Auth{Mechanism: AuthCRAMMD5, User: "user", Pass: "pass"}, nil, 1, 0)
+	if _, err := server.Send(context.Background(), testMessage(), false); err == nil {
+		t.Errorf("expected an error - the server doesn't support 'AUTH'")
+	}
+
+	server = New(addr, Auth{Mechanism: AuthNone}, nil, 1, 0)
+	if _, err := server.Send(context.Background(), testMessage(), false); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(received); n != 1 {
+		t.Errorf("expected one received mail, found: %d", n)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	ioutil.WriteFile(path, []byte("first\n"), 0600)
+	source := TokenFile(path)
+	if token, err := source.Token(context.Background()); err != nil || token != "first" {
+		t.Errorf("unexpected token: '%s' (%v)", token, err)
+	}
+
+	// a refreshed token should be used
+	ioutil.WriteFile(path, []byte("second"), 0600)
+	if token, err := source.Token(context.Background()); err != nil || token != "second" {
+		t.Errorf("unexpected token: '%s' (%v)", token, err)
+	}
+}
+
+// the token should be cached until it expires
+func TestTokenEndpoint(t *testing.T) {
+	requests := 0
+	expiresIn := 3600
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" || r.Form.Get("client_id") != "id" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":%d}`, requests, expiresIn)
+	}))
+	defer server.Close()
+
+	source := TokenEndpoint(server.URL, "id", "secret", "refresh")
+	for i := 0; i < 2; i++ {
+		if token, err := source.Token(context.Background()); err != nil || token != "token-1" {
+			t.Errorf("unexpected token: '%s' (%v)", token, err)
+		}
+	}
+
+	// an expired token should be refreshed
+	source.(*tokenEndpoint).expires = time.Now().Add(-time.Second)
+	if token, err := source.Token(context.Background()); err != nil || token != "token-2" {
+		t.Errorf("unexpected token: '%s' (%v)", token, err)
+	}
+
+	invalid := TokenEndpoint(server.URL, "id", "secret", "revoked")
+	if _, err := invalid.Token(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("expected the 'invalid_grant' error, found: %v", err)
+	}
+}
@@ -2,20 +2,132 @@ package mail
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
 )
 
+// time format of the 'Date' header (https://tools.ietf.org/html/rfc5322#section-3.3)
+const DateFormat = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+// max. line length of the header lines - longer lines are folded
+// (https://tools.ietf.org/html/rfc5322#section-2.1.1)
+const headerLineLength = 78
+
 // ComposeMessage composes an mail-message from the given
-// mail-header and content
-func ComposeMessage(header Header, content string) *Message {
+// mail-header and content - with the attachments as 'multipart/mixed' message
+func ComposeMessage(header Header, content string, attachments ...Attachment) *Message {
+	return compose(header, content, "", attachments)
+}
+
+// ComposeHTMLMessage composes a 'multipart/alternative' mail-message with
+// the given text and html content - with the attachments as 'multipart/mixed' message
+func ComposeHTMLMessage(header Header, text, html string, attachments ...Attachment) *Message {
+	return compose(header, text, html, attachments)
+}
+
+func compose(header Header, text, html string, attachments []Attachment) *Message {
+	if header.Timestamp == "" {
+		header.Timestamp = time.Now().Format(DateFormat)
+	}
+	if header.MessageID == "" {
+		header.MessageID = newMessageID(header.From)
+	}
+
 	mcb := newMessageContentBuilder()
-	mcb.AppendHeader("From", header.From)
-	mcb.AppendHeader("To", header.To)
-	mcb.AppendHeader("Subject", header.Subject)
+	mcb.AppendHeader("From", formatAddress(header.FromName, header.From))
+	// a mail with only 'Bcc' recipients gets an empty group - per RFC 5322
+	if len(header.To) > 0 {
+		mcb.AppendHeader("To", header.To.format())
+	} else if len(header.Cc) == 0 {
+		mcb.AppendHeader("To", "undisclosed-recipients:;")
+	}
+	if len(header.Cc) > 0 {
+		mcb.AppendHeader("Cc", header.Cc.format())
+	}
+	if header.ReplyTo != "" {
+		mcb.AppendHeader("Reply-To", header.ReplyTo)
+	}
+	mcb.AppendHeader("Subject", mime.QEncoding.Encode("utf-8", header.Subject))
 	mcb.AppendHeader("Date", header.Timestamp)
-	mcb.AppendHeader("Content-type", "text/plain; charset=utf-8")
-	mcb.AppendContent(content)
+	mcb.AppendHeader("Message-ID", header.MessageID)
+	if header.InReplyTo != "" {
+		mcb.AppendHeader("In-Reply-To", header.InReplyTo)
+	}
+	if header.References != "" {
+		mcb.AppendHeader("References", header.References)
+	}
+	mcb.AppendHeader("MIME-Version", "1.0")
+	if len(attachments) > 0 || html != "" {
+		mcb.AppendMultipart(text, html, attachments)
+	} else {
+		encoding, body := encodeText(text)
+		mcb.AppendHeader("Content-type", "text/plain; charset=utf-8")
+		mcb.AppendHeader("Content-Transfer-Encoding", encoding)
+		mcb.AppendContent(body)
+	}
+
+	return &Message{header, mcb.String(), text}
+}
 
-	return &Message{header, mcb.String(), content}
+// formatAddress adds the display name to the address, if it's not empty.
+// non-ascii names are encoded (https://tools.ietf.org/html/rfc2047)
+func formatAddress(name, addr string) string {
+	if name == "" {
+		return addr
+	}
+	return (&mail.Address{Name: name, Address: addr}).String()
+}
+
+// newMessageID returns an unique id in angle brackets - with the domain of the given address
+var newMessageID = func(addr string) string {
+	domain := "matterbot"
+	if i := strings.LastIndex(addr, "@"); i >= 0 && i+1 < len(addr) {
+		domain = addr[i+1:]
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "<" + hex.EncodeToString(id) + "@" + domain + ">"
+}
+
+// encodeText returns the transfer encoding and the encoded text:
+//
+//   - '7bit' if the text is ascii with short lines
+//   - 'quoted-printable' otherwise
+//
+// the line breaks are normalized to CRLF.
+func encodeText(text string) (string, string) {
+	if is7bit(text) {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		return "7bit", strings.ReplaceAll(text, "\n", "\r\n")
+	}
+
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(text))
+	qp.Close()
+	return "quoted-printable", buf.String()
+}
+
+// is7bit returns 'true' if the text is printable ascii, with lines not longer
+// than the quoted-printable lines
+func is7bit(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if len(strings.TrimSuffix(line, "\r")) > base64LineLength {
+			return false
+		}
+		for i := 0; i < len(line); i++ {
+			if c := line[i]; (c < ' ' || c > '~') && c != '\t' && c != '\r' {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 type messageContentBuilder struct {
@@ -26,10 +138,10 @@ func newMessageContentBuilder() messageContentBuilder {
 	return messageContentBuilder{}
 }
 
+// AppendHeader appends the header - lines longer than 'headerLineLength' are folded
+// at whitespace. the value must be encoded already.
 func (mb *messageContentBuilder) AppendHeader(n, v string) {
-	mb.buf.WriteString(n)
-	mb.buf.WriteString(": ")
-	mb.buf.WriteString(v)
+	mb.buf.WriteString(foldHeader(n, v))
 	mb.buf.WriteString("\r\n")
 }
 
@@ -42,3 +154,31 @@ func (mb *messageContentBuilder) AppendContent(s string) {
 func (mb *messageContentBuilder) String() string {
 	return mb.buf.String()
 }
+
+// foldHeader returns the header line - folded before the last space which fits in
+// 'headerLineLength'. words which are longer than a line are not split.
+// (https://tools.ietf.org/html/rfc5322#section-2.2.3)
+func foldHeader(name, value string) string {
+	line := name + ": " + value
+
+	// the first line isn't folded between the name and the value
+	start := len(name) + 1
+
+	var buf strings.Builder
+	for len(line) > headerLineLength {
+		i := strings.LastIndexByte(line[:headerLineLength+1], ' ')
+		if i <= start {
+			// fold after the long word
+			j := strings.IndexByte(line[start+1:], ' ')
+			if j < 0 {
+				break
+			}
+			i = start + 1 + j
+		}
+		buf.WriteString(line[:i])
+		buf.WriteString("\r\n")
+		line, start = line[i:], 0
+	}
+	buf.WriteString(line)
+	return buf.String()
+}
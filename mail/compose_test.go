@@ -0,0 +1,200 @@
+package mail
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in 'testdata'")
+
+// the composed messages are compared with the golden files in 'testdata' - run
+// 'go test ./mail -update' to update them
+func TestComposeMessageGolden(t *testing.T) {
+	origBoundary := newBoundary
+	defer func() { newBoundary = origBoundary }()
+
+	header := Header{
+		From:      "matterbot@example.com",
+		To:        AddressList{{Address: "ml@example.com"}},
+		Subject:   "mattermost: user1 writes in channel town-square",
+		Timestamp: "Sat, 17 Oct 2026 12:00:00 +0200",
+		MessageID: "<post-1@example.com>",
+	}
+
+	tests := []struct {
+		name    string
+		header  func(Header) Header
+		compose func(Header) *Message
+	}{
+		{
+			name:    "plain",
+			compose: func(h Header) *Message { return ComposeMessage(h, "we meet us at 4pm\nin the lab") },
+		},
+		{
+			name: "umlauts",
+			header: func(h Header) Header {
+				h.FromName = "Matterbot"
+				h.To = AddressList{{Name: "Müller, Jürgen", Address: "ml@example.com"}}
+				h.Subject = "Grüße aus dem Käsekeller"
+				return h
+			},
+			compose: func(h Header) *Message { return ComposeMessage(h, "Schöne Grüße - bis später!") },
+		},
+		{
+			name: "folding",
+			header: func(h Header) Header {
+				h.Subject = strings.Repeat("a long subject ", 10) + "- " + strings.Repeat("mit Umlauten äöü ", 6)
+				h.InReplyTo = "<post-0@example.com>"
+				h.References = "<post-a@example.com> <post-b@example.com> <post-c@example.com> <post-0@example.com>"
+				return h
+			},
+			compose: func(h Header) *Message { return ComposeMessage(h, strings.Repeat("a long line ", 100)) },
+		},
+		{
+			name: "bcc-only",
+			header: func(h Header) Header {
+				h.To = nil
+				h.Bcc = AddressList{{Address: "audit@example.com"}}
+				return h
+			},
+			compose: func(h Header) *Message { return ComposeMessage(h, "for the archive") },
+		},
+		{
+			name: "html",
+			compose: func(h Header) *Message {
+				return ComposeHTMLMessage(h, "bold: see the docs (https://example.com)",
+					`<p><strong>bold</strong>: see <a href="https://example.com" rel="nofollow">the docs</a></p>`)
+			},
+		},
+		{
+			name: "attachments",
+			compose: func(h Header) *Message {
+				return ComposeHTMLMessage(h, "see the file", "<p>see the file</p>",
+					Attachment{Name: "Überblick.txt", ContentType: "text/plain", Data: []byte("hello")})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		n := 0
+		newBoundary = func() string {
+			n++
+			return fmt.Sprintf("boundary-%d", n)
+		}
+
+		h := header
+		if test.header != nil {
+			h = test.header(h)
+		}
+		msg := test.compose(h)
+
+		golden := filepath.Join("testdata", test.name+".golden")
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(msg.Body), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Body != string(expected) {
+			t.Errorf("test: '%s' - message differs from '%s':\n%s", test.name, golden, msg.Body)
+		}
+
+		// the message should be parseable, with the original header values
+		parsed, err := mail.ReadMessage(strings.NewReader(msg.Body))
+		if err != nil {
+			t.Fatalf("test: '%s' - %s", test.name, err.Error())
+		}
+		subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+		if err != nil || subject != h.Subject {
+			t.Errorf("test: '%s' - expected subject: %q, found: %q (%v)", test.name, h.Subject, subject, err)
+		}
+		// without 'To' recipients: the empty group 'undisclosed-recipients:;'
+		to, err := parsed.Header.AddressList("To")
+		if err != nil || len(to) != len(h.To) {
+			t.Errorf("test: '%s' - unexpected 'To': %v (%v)", test.name, to, err)
+		}
+		for i := 0; err == nil && i < len(to) && i < len(h.To); i++ {
+			if to[i].Name != h.To[i].Name || to[i].Address != h.To[i].Address {
+				t.Errorf("test: '%s' - unexpected 'To': %v", test.name, to[i])
+			}
+		}
+		if parsed.Header.Get("Bcc") != "" {
+			t.Errorf("test: '%s' - the 'Bcc' recipients should not be in the header", test.name)
+		}
+
+		for _, line := range strings.Split(msg.Body, "\r\n") {
+			if len(line) > 998 {
+				t.Errorf("test: '%s' - line exceeds 998 characters: %q", test.name, line)
+			}
+		}
+	}
+}
+
+func TestComposeMessageGeneratesMessageIDAndDate(t *testing.T) {
+	msg := ComposeMessage(Header{From: "matterbot@example.com", To: AddressList{{Address: "ml@example.com"}}}, "content")
+
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := parsed.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("unexpected message-id: %s", id)
+	}
+	if _, err := parsed.Header.Date(); err != nil {
+		t.Errorf("invalid date: %s - error: %s", parsed.Header.Get("Date"), err.Error())
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"short", "Subject: short"},
+		{strings.Repeat("word ", 19) + "word", "Subject: " + strings.Repeat("word ", 13) + "word\r\n" + strings.Repeat(" word", 6)},
+		{strings.Repeat("x", 100), "Subject: " + strings.Repeat("x", 100)},
+		{strings.Repeat("x", 100) + " end", "Subject: " + strings.Repeat("x", 100) + "\r\n end"},
+		{"x " + strings.Repeat("y", 100), "Subject: x\r\n " + strings.Repeat("y", 100)},
+	}
+
+	for _, test := range tests {
+		if folded := foldHeader("Subject", test.value); folded != test.expected {
+			t.Errorf("value: %q\n\texpected: %q\n\tfound:    %q", test.value, test.expected, folded)
+		}
+	}
+}
+
+// all recipients should be in the envelope - but the 'Bcc' recipients not in the header
+func TestComposeMessageWithRecipientLists(t *testing.T) {
+	msg := ComposeMessage(Header{
+		From: "matterbot@example.com",
+		To:   AddressList{{Name: "List", Address: "ml@example.com"}, {Address: "archive@example.com"}},
+		Cc:   AddressList{{Address: "board@example.com"}},
+		Bcc:  AddressList{{Address: "secret@example.com"}},
+	}, "content")
+
+	expected := []string{"ml@example.com", "archive@example.com", "board@example.com", "secret@example.com"}
+	if rcpts := msg.Recipients(); strings.Join(rcpts, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected recipients: %v, found: %v", expected, rcpts)
+	}
+
+	if !strings.Contains(msg.Body, "To: \"List\" <ml@example.com>, archive@example.com\r\n") ||
+		!strings.Contains(msg.Body, "Cc: board@example.com\r\n") || strings.Contains(msg.Body, "secret@example.com") {
+		t.Errorf("unexpected header: %s", msg.Body)
+	}
+
+	retry := msg.ForRecipients([]string{"board@example.com"})
+	if rcpts := retry.Recipients(); len(rcpts) != 1 || rcpts[0] != "board@example.com" || retry.Body != msg.Body {
+		t.Errorf("unexpected retry message: %+v", retry)
+	}
+}
@@ -0,0 +1,119 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// NewMaildir instantiates a mail-system, which writes the mails in the given
+// maildir - like for an archive or for tests. the directories of the maildir
+// are created if they don't exist.
+func NewMaildir(dir string) (Server, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("unable to create the maildir - %s", err.Error())
+		}
+	}
+	return &maildirServer{dir: dir}, nil
+}
+
+type maildirServer struct {
+	dir string
+}
+
+// unique part of the maildir file names
+var maildirCounter int64
+
+// Send writes the message in the 'new' directory of the maildir - per 'tmp'
+// directory, so a reader never sees a partial mail. the 'useTLS' flag is ignored.
+func (s *maildirServer) Send(ctx context.Context, msg *Message, useTLS bool) ([]Result, error) {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddInt64(&maildirCounter, 1), strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname))
+
+	tmpFile := filepath.Join(s.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpFile, []byte(localLines(msg.Body)), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpFile, filepath.Join(s.dir, "new", name)); err != nil {
+		os.Remove(tmpFile)
+		return nil, err
+	}
+
+	logger.Debugf("mail written to maildir: %s - file: %s", s.dir, name)
+	return acceptAll(msg), nil
+}
+
+// Close does nothing - the files are closed after each send
+func (s *maildirServer) Close() error {
+	return nil
+}
+
+// NewMbox instantiates a mail-system, which appends the mails to the given mbox
+// file - like for an archive or for tests. the file is created if it doesn't exist.
+func NewMbox(path string) (Server, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the mbox file - %s", err.Error())
+	}
+	f.Close()
+	return &mboxServer{path: path}, nil
+}
+
+type mboxServer struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// lines which must be quoted in a mbox - per 'mboxrd'
+var mboxFromRegexp = regexp.MustCompile(`(?m)^(>*From )`)
+
+// Send appends the message to the mbox file - the 'useTLS' flag is ignored.
+//
+// the mails are separated per 'From ' line, and 'From ' lines in the
+// mail are quoted per '>' ('mboxrd' format).
+func (s *mboxServer) Send(ctx context.Context, msg *Message, useTLS bool) ([]Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	from := msg.Header.From
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	body := mboxFromRegexp.ReplaceAllString(localLines(msg.Body), ">$1")
+	if !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	entry := "From " + from + " " + time.Now().UTC().Format(time.ANSIC) + "\n" + body + "\n"
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(entry); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("mail appended to mbox: %s", s.path)
+	return acceptAll(msg), nil
+}
+
+// Close does nothing - the file is closed after each send
+func (s *mboxServer) Close() error {
+	return nil
+}
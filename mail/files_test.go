@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSendToMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, err := NewMaildir(filepath.Join(dir, "Maildir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := server.Send(context.Background(), testMessage(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "Maildir", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 mails in 'new', found: %d", len(files))
+	}
+	if tmp, _ := ioutil.ReadDir(filepath.Join(dir, "Maildir", "tmp")); len(tmp) != 0 {
+		t.Errorf("expected an empty 'tmp' directory, found: %d files", len(tmp))
+	}
+
+	mail, _ := ioutil.ReadFile(filepath.Join(dir, "Maildir", "new", files[0].Name()))
+	if !strings.Contains(string(mail), "To: b@localhost\n") || strings.Contains(string(mail), "\r") {
+		t.Errorf("unexpected mail: %q", mail)
+	}
+}
+
+// the mails should be separated per 'From ' line - 'From ' lines in the content are quoted
+func TestSendToMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive.mbox")
+	server, err := NewMbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := ComposeMessage(Header{From: "a@localhost", To: AddressList{{Address: "b@localhost"}}}, "From here\n>From there")
+	for i := 0; i < 2; i++ {
+		if _, err := server.Send(context.Background(), msg, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox := string(buf)
+	if !strings.HasPrefix(mbox, "From a@localhost ") || strings.Count(mbox, "\nFrom a@localhost ") != 1 {
+		t.Errorf("expected 2 mails per 'From ' line: %s", mbox)
+	}
+	if strings.Count(mbox, "\n>From here\n>>From there\n") != 2 {
+		t.Errorf("the 'From ' lines in the content should be quoted: %s", mbox)
+	}
+}
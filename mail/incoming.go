@@ -0,0 +1,156 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Incoming is a received mail
+type Incoming struct {
+	// the envelope sender and recipients
+	From string
+	To   []string
+
+	Header mail.Header
+
+	// the decoded 'text/plain' content
+	Text string
+}
+
+// ParseIncoming parses the received mail - the mail needs a 'text/plain' part
+func ParseIncoming(from string, to []string, data []byte) (*Incoming, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mail: %s", err.Error())
+	}
+
+	text, found, err := textContent(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mail content: %s", err.Error())
+	}
+	if !found {
+		return nil, errors.New("mail without 'text/plain' content")
+	}
+
+	return &Incoming{From: from, To: to, Header: msg.Header, Text: text}, nil
+}
+
+// Sender returns the display name of the sender - the address if
+// the sender has no name
+func (in *Incoming) Sender() string {
+	addr, err := in.Header.AddressList("From")
+	if err != nil || len(addr) == 0 {
+		return in.From
+	}
+	if addr[0].Name != "" {
+		return addr[0].Name
+	}
+	return addr[0].Address
+}
+
+// ThreadIDs returns the message ids from the 'In-Reply-To' and the 'References'
+// header - the nearest first. the ids are in angle brackets: '<id@domain>'
+func (in *Incoming) ThreadIDs() []string {
+	ids := messageIDs(in.Header.Get("In-Reply-To"))
+
+	refs := messageIDs(in.Header.Get("References"))
+	for i := len(refs) - 1; i >= 0; i-- {
+		ids = append(ids, refs[i])
+	}
+	return ids
+}
+
+// messageIDs returns the ids from a header value - like: '<a@x> <b@x>'
+func messageIDs(value string) []string {
+	ids := []string{}
+	for {
+		start := strings.IndexByte(value, '<')
+		end := strings.IndexByte(value, '>')
+		if start < 0 || end < start {
+			return ids
+		}
+		ids = append(ids, value[start:end+1])
+		value = value[end+1:]
+	}
+}
+
+// textContent returns the decoded 'text/plain' content with '\n' line breaks - in
+// a multipart mail the first 'text/plain' part, which isn't an attachment
+func textContent(contentType, encoding string, body io.Reader) (string, bool, error) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false, err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			// 'quoted-printable' parts are decoded from the reader
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", false, nil
+			}
+			if err != nil {
+				return "", false, err
+			}
+			if strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment") {
+				continue
+			}
+
+			text, found, err := textContent(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil || found {
+				return text, found, err
+			}
+		}
+	}
+
+	if mediaType != "text/plain" {
+		return "", false, nil
+	}
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		// the line breaks are ignored from the decoder
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", false, err
+	}
+	text := decodeCharset(data, params["charset"])
+	return strings.ReplaceAll(text, "\r\n", "\n"), true, nil
+}
+
+// decodeCharset converts the text to utf-8 - only 'latin1' is converted, other
+// charsets are expected to be utf-8 compatible
+func decodeCharset(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso-8859-15", "latin1", "windows-1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+
+	if !utf8.Valid(data) {
+		return strings.ToValidUTF8(string(data), "�")
+	}
+	return string(data)
+}
@@ -0,0 +1,66 @@
+package mail
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIncoming(t *testing.T) {
+	tests := []struct {
+		name     string
+		mail     string
+		expected string
+	}{
+		{"plain", "Subject: x\r\n\r\nline 1\r\nline 2", "line 1\nline 2"},
+		{"quoted-printable latin1",
+			"Content-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nGr=FC=DFe aus K=F6ln",
+			"Grüße aus Köln"},
+		{"base64",
+			"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\nR3LDvMOfZSBh\r\ndXMgS8O2bG4=",
+			"Grüße aus Köln"},
+		{"alternative",
+			"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nGr=C3=BC=C3=9Fe\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>Grüße</p>\r\n--b--\r\n",
+			"Grüße"},
+		{"mixed with attachment first",
+			"Content-Type: multipart/mixed; boundary=m\r\n\r\n" +
+				"--m\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=a.txt\r\n\r\nattachment\r\n" +
+				"--m\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nthe text\r\n--b--\r\n" +
+				"--m--\r\n",
+			"the text"},
+	}
+
+	for _, test := range tests {
+		in, err := ParseIncoming("alice@example.com", []string{"bot@example.com"}, []byte(test.mail))
+		if err != nil {
+			t.Errorf("test: '%s' - unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		if in.Text != test.expected {
+			t.Errorf("test: '%s' - expected: %q, found: %q", test.name, test.expected, in.Text)
+		}
+	}
+}
+
+func TestParseIncomingWithoutText(t *testing.T) {
+	mail := "Content-Type: text/html\r\n\r\n<p>html only</p>"
+	if _, err := ParseIncoming("alice@example.com", nil, []byte(mail)); err == nil || !strings.Contains(err.Error(), "text/plain") {
+		t.Errorf("expected an error for a mail without 'text/plain' - found: %v", err)
+	}
+}
+
+func TestIncomingThreadIDs(t *testing.T) {
+	mail := "In-Reply-To: <c@example.com>\r\nReferences: <a@example.com>\r\n <b@example.com> <c@example.com>\r\n\r\ntext"
+	in, err := ParseIncoming("alice@example.com", nil, []byte(mail))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"<c@example.com>", "<c@example.com>", "<b@example.com>", "<a@example.com>"}
+	if ids := in.ThreadIDs(); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected: %v, found: %v", expected, ids)
+	}
+}
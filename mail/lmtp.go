@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// NewLMTP instantiates the mail-system for a lmtp server - like a list server
+// per unix socket ('unix', '/run/lmtp.sock') or per tcp ('tcp', 'host:port').
+//
+// a connection is opened per send - lmtp servers are local, so there is no
+// authentication and no TLS.
+func NewLMTP(network, addr string) Server {
+	return &lmtpServer{network: network, addr: addr}
+}
+
+type lmtpServer struct {
+	network string
+	addr    string
+}
+
+// Send delivers the message per lmtp - the 'useTLS' flag is ignored.
+//
+// lmtp replies after the data per recipient - so the recipients can be
+// rejected after the data too.
+func (s *lmtpServer) Send(ctx context.Context, msg *Message, useTLS bool) ([]Result, error) {
+	logger.Debugf("send mail per lmtp - addr: %s, from: %s, to: %v", s.addr, msg.Header.From, msg.Recipients())
+
+	dialer := &net.Dialer{}
+	con, err := dialer.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	stop := closeOnDone(ctx, con)
+	results, err := lmtpDeliver(textproto.NewConn(con), msg)
+	if ctxErr := stop(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return results, err
+}
+
+// Close does nothing - there are no idle connections
+func (s *lmtpServer) Close() error {
+	return nil
+}
+
+// lmtpDeliver sends the message in a lmtp session
+func lmtpDeliver(text *textproto.Conn, msg *Message) ([]Result, error) {
+	cmd := func(code int, format string, xs ...interface{}) error {
+		id, err := text.Cmd(format, xs...)
+		if err != nil {
+			return err
+		}
+		text.StartResponse(id)
+		defer text.EndResponse(id)
+		_, _, err = text.ReadResponse(code)
+		return err
+	}
+
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return nil, err
+	}
+	if err := cmd(250, "LHLO localhost"); err != nil {
+		return nil, err
+	}
+	if err := cmd(250, "MAIL FROM:<%s>", msg.Header.From); err != nil {
+		return nil, err
+	}
+
+	// the indexes of the accepted recipients - for the replies after the data
+	results := []Result{}
+	accepted := []int{}
+	for _, rcpt := range msg.Recipients() {
+		err := cmd(25, "RCPT TO:<%s>", rcpt)
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			return nil, err
+		}
+		if err == nil {
+			accepted = append(accepted, len(results))
+		}
+		results = append(results, Result{Recipient: rcpt, Err: err})
+	}
+
+	if len(accepted) == 0 {
+		logger.Debug("all recipients are rejected - skip the delivery")
+		cmd(221, "QUIT")
+		return results, nil
+	}
+
+	if err := cmd(354, "DATA"); err != nil {
+		return nil, err
+	}
+	writer := text.DotWriter()
+	if _, err := writer.Write([]byte(msg.Body)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, i := range accepted {
+		_, _, err := text.ReadResponse(250)
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			return nil, err
+		}
+		results[i].Err = err
+	}
+
+	cmd(221, "QUIT")
+	return results, nil
+}
@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// startLMTPReceiver starts a local lmtp server on a unix socket
+func startLMTPReceiver(t *testing.T, handler func(*Incoming) error) (string, func()) {
+	dir, err := ioutil.TempDir("", "matterbot-lmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "lmtp.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewReceiver(socket, handler)
+	receiver.listener = listener
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go receiver.Serve(ctx)
+	return socket, func() {
+		cancel()
+		os.RemoveAll(dir)
+	}
+}
+
+// the rejected recipients should be returned in the results
+func TestSendPerLMTP(t *testing.T) {
+	var mu sync.Mutex
+	var received *Incoming
+	socket, stop := startLMTPReceiver(t, func(in *Incoming) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = in
+		return nil
+	})
+	defer stop()
+
+	msg := ComposeMessage(Header{
+		From: "a@localhost",
+		To:   AddressList{{Address: "b@localhost"}},
+		Bcc:  AddressList{{Address: ""}, {Address: "c@localhost"}},
+	}, "content")
+
+	results, err := NewLMTP("unix", socket).Send(context.Background(), msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Err != nil || results[1].Err == nil || results[2].Err != nil {
+		t.Errorf("unexpected results: %v", results)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if received == nil || strings.Join(received.To, ",") != "b@localhost,c@localhost" || strings.TrimSpace(received.Text) != "content" {
+		t.Errorf("unexpected received mail: %+v", received)
+	}
+}
+
+// lmtp rejects the mail after the data per recipient
+func TestSendPerLMTPRejectedAfterData(t *testing.T) {
+	socket, stop := startLMTPReceiver(t, func(in *Incoming) error {
+		return errors.New("mailbox full")
+	})
+	defer stop()
+
+	msg := ComposeMessage(Header{
+		From: "a@localhost",
+		To:   AddressList{{Address: "b@localhost"}, {Address: "c@localhost"}},
+	}, "content")
+
+	results, err := NewLMTP("unix", socket).Send(context.Background(), msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, found: %v", results)
+	}
+	for _, r := range results {
+		if r.Err == nil || !IsPermanent(r.Err) {
+			t.Errorf("recipient: %s - expected a permanent error, found: %v", r.Recipient, r.Err)
+		}
+	}
+}
@@ -2,25 +2,60 @@
 package mail
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
 
 	"github.com/section77/matterbot/logger"
 )
 
 // Server defines the interface to the mail-system
 type Server interface {
-	Send(*Message, bool) error
+	// Send delivers the message to all recipients in one session - the error
+	// is returned if the session fails, the results per recipient otherwise
+	Send(context.Context, *Message, bool) ([]Result, error)
+
+	// Close closes the idle sessions
+	Close() error
+}
+
+// Result is the delivery result for a recipient
+type Result struct {
+	Recipient string
+
+	// 'nil' if the recipient is accepted
+	Err error
+}
+
+// IsPermanent reports if the error is a permanent rejection from the mail-server - a
+// reply code 5xx. temporary errors (4xx) and network errors can be retried.
+func IsPermanent(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
 }
 
 // Header representes the mail-header
 type Header struct {
 	From      string
-	To        string
+	FromName  string
+	To        AddressList
+	Cc        AddressList
+	Bcc       AddressList // only in the envelope - not in the header
+	ReplyTo   string
 	Subject   string
-	Timestamp string
+	Timestamp string // per 'DateFormat' - the current time if empty
+
+	// threading - the ids are in angle brackets: '<id@domain>'.
+	// an unique message-id is generated if empty.
+	MessageID  string
+	InReplyTo  string
+	References string
 }
 
 // Message represents an mail-message
@@ -30,38 +65,142 @@ type Message struct {
 	Content string
 }
 
-func New(host, user, pass string) Server {
-	return &serverImpl{
+// Recipients returns the envelope recipients - from 'To', 'Cc' and 'Bcc'
+func (h *Header) Recipients() []string {
+	addrs := h.To.Addresses()
+	addrs = append(addrs, h.Cc.Addresses()...)
+	return append(addrs, h.Bcc.Addresses()...)
+}
+
+// Recipients returns the envelope recipients of the message
+func (msg *Message) Recipients() []string {
+	return msg.Header.Recipients()
+}
+
+// ForRecipients returns a copy of the message, which is delivered only to the given
+// recipients - like to retry the rejected recipients. the composed body isn't changed.
+func (msg *Message) ForRecipients(addrs []string) *Message {
+	m := *msg
+	m.Header.To = AddressList{}
+	m.Header.Cc, m.Header.Bcc = nil, nil
+	for _, addr := range addrs {
+		m.Header.To = append(m.Header.To, Address{Address: addr})
+	}
+	return &m
+}
+
+// New instantiates the mail-system for the given mail-server - the sessions
+// are authenticated per 'auth', and encrypted per 'tlsSettings' (the defaults
+// if 'nil').
+//
+// the smtp sessions are pooled: max. 'poolSize' sessions are open at the same
+// time, and an idle session is closed after 'idleTimeout' - an 'idleTimeout' of
+// zero closes each session after the send.
+func New(host string, auth Auth, tlsSettings *TLS, poolSize int, idleTimeout time.Duration) Server {
+	if tlsSettings == nil {
+		tlsSettings = defaultTLS
+	}
+	s := &serverImpl{
 		host: host,
-		user: user,
-		pass: pass,
+		auth: auth,
+		tls:  tlsSettings,
 	}
+	s.pool = newPool(poolSize, idleTimeout, s.connect)
+	return s
 }
 
 type serverImpl struct {
 	host string
-	user string
-	pass string
+	auth Auth
+	tls  *TLS
+	pool *pool
 }
 
-// Send the given message
-func (s *serverImpl) Send(msg *Message, useTLS bool) error {
+// Send the given message - per a pooled smtp session.
+//
+// if the context is canceled, the smtp session is aborted and
+// the context error is returned.
+func (s *serverImpl) Send(ctx context.Context, msg *Message, useTLS bool) ([]Result, error) {
 	logger.Debugf("send mail (per %s) - host: %s, from: %s, to: %s",
-		protocolStr(useTLS), s.host, msg.Header.From, msg.Header.To)
+		protocolStr(useTLS), s.host, msg.Header.From, strings.Join(msg.Recipients(), ", "))
+
+	session, err := s.pool.get(ctx, useTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := closeOnDone(ctx, session.con)
+	results, err := deliver(session.client, msg)
+	if ctxErr := stop(); ctxErr != nil {
+		s.pool.put(session, false)
+		return nil, ctxErr
+	}
 
+	s.pool.put(session, err == nil)
+	return results, err
+}
+
+// Close closes the idle sessions - sessions in use are closed after the send
+func (s *serverImpl) Close() error {
+	s.pool.close()
+	return nil
+}
+
+// connect opens a new smtp session - the session is authenticated
+func (s *serverImpl) connect(ctx context.Context, useTLS bool) (*smtpSession, error) {
+	// the host part can't have a port number
 	host, _, _ := net.SplitHostPort(s.host)
-	auth := smtp.PlainAuth(
-		"",
-		s.user,
-		s.pass,
-		// the host part can't have a port number
-		host,
-	)
 
+	con, err := dial(ctx, s.host, s.tls.clientConfig(host), useTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	// abort the handshake if the context is canceled
+	stop := closeOnDone(ctx, con)
+	var client *smtp.Client
 	if useTLS {
-		return s.sendPerTLS(host, auth, msg)
+		client, err = smtp.NewClient(con, host)
+	} else {
+		client, err = startPerSTARTTLS(con, host, s.tls)
+	}
+	if err == nil {
+		err = s.auth.authenticate(ctx, client, host)
+	}
+	if ctxErr := stop(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+
+	logger.Debugf("new smtp session (per %s) - host: %s", protocolStr(useTLS), s.host)
+	return &smtpSession{con: con, client: client, useTLS: useTLS}, nil
+}
+
+// closeOnDone closes the connection if the context is canceled - until 'stop'
+// is called. 'stop' returns the context error if the connection was closed.
+func closeOnDone(ctx context.Context, con net.Conn) (stop func() error) {
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			con.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+
+	return func() error {
+		close(done)
+		if <-closed {
+			return ctx.Err()
+		}
+		return nil
 	}
-	return s.sendPerSTARTTLS(auth, msg)
 }
 
 func protocolStr(useTLS bool) string {
@@ -72,55 +211,81 @@ func protocolStr(useTLS bool) string {
 	return protocol
 }
 
-func (s *serverImpl) sendPerSTARTTLS(auth smtp.Auth, msg *Message) error {
-	return smtp.SendMail(
-		s.host,
-		auth,
-		msg.Header.From,
-		[]string{msg.Header.To},
-		[]byte(msg.Body),
-	)
-}
+// dial connects to the mail-server - per TLS if 'useTLS' is set
+func dial(ctx context.Context, addr string, config *tls.Config, useTLS bool) (net.Conn, error) {
+	if useTLS {
+		dialer := &tls.Dialer{Config: config}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
 
-func (s *serverImpl) sendPerTLS(host string, auth smtp.Auth, msg *Message) error {
-	var err error
-	var con *tls.Conn
-	var client *smtp.Client
-	var writer io.WriteCloser
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
 
-	if con, err = tls.Dial("tcp", s.host, &tls.Config{
-		ServerName: host,
-	}); err != nil {
-		return err
+// startPerSTARTTLS upgrades the connection per the STARTTLS policy - with
+// 'StartTLSRequired' the session fails if the server doesn't offer STARTTLS
+func startPerSTARTTLS(con net.Conn, host string, t *TLS) (*smtp.Client, error) {
+	client, err := smtp.NewClient(con, host)
+	if err != nil {
+		return nil, err
+	}
+	if t.startTLS == StartTLSOff {
+		return client, nil
 	}
 
-	if client, err = smtp.NewClient(con, host); err != nil {
-		return err
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		if t.startTLS == StartTLSRequired {
+			client.Close()
+			return nil, errors.New("the mail-server doesn't offer STARTTLS - but it's required")
+		}
+		logger.Debugf("the mail-server: %s doesn't offer STARTTLS - the mails are sent unencrypted", host)
+		return client, nil
 	}
 
-	if err = client.Auth(auth); err != nil {
-		return err
+	if err = client.StartTLS(t.clientConfig(host)); err != nil {
+		return nil, err
 	}
+	return client, nil
+}
+
+// deliver sends the message over an established (and authenticated) session - with
+// a 'RCPT TO' per recipient. the rejected recipients are returned in the results,
+// the message is delivered to the accepted recipients.
+//
+// the session stays open - it's reset per 'RSET' from the pool.
+func deliver(client *smtp.Client, msg *Message) ([]Result, error) {
+	var err error
+	var writer io.WriteCloser
 
 	if err = client.Mail(msg.Header.From); err != nil {
-		return err
+		return nil, err
 	}
 
-	if err = client.Rcpt(msg.Header.To); err != nil {
-		return err
+	results := []Result{}
+	accepted := 0
+	for _, rcpt := range msg.Recipients() {
+		err := client.Rcpt(rcpt)
+		if err == nil {
+			accepted++
+		}
+		results = append(results, Result{Recipient: rcpt, Err: err})
+	}
+
+	if accepted == 0 {
+		logger.Debug("all recipients are rejected - skip the delivery")
+		return results, nil
 	}
 
 	if writer, err = client.Data(); err != nil {
-		return err
+		return nil, err
 	}
 
 	if _, err = writer.Write([]byte(msg.Body)); err != nil {
-		return err
+		return nil, err
 	}
 
 	if err = writer.Close(); err != nil {
-		return err
+		return nil, err
 	}
-
-	return client.Quit()
+	return results, nil
 }
@@ -0,0 +1,96 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a canceled context should abort a hanging smtp session
+func TestSendAbortsOnCanceledContext(t *testing.T) {
+	// stand-in for a mail-server which accepts connections, but never responds
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			con, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer con.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	server := New(listener.Addr().String(), Auth{User: "user", Pass: "pass"}, nil, 1, 0)
+	errC := make(chan error)
+	go func() {
+		_, err := server.Send(ctx, &Message{Header: Header{From: "a@localhost", To: AddressList{{Address: "b@localhost"}}}}, false)
+		errC <- err
+	}()
+
+	select {
+	case err := <-errC:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected error: %v, received: %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("'Send' didn't abort")
+	}
+}
+
+// a rejected recipient shouldn't fail the delivery to the other recipients
+func TestSendReturnsResultsPerRecipient(t *testing.T) {
+	var mu sync.Mutex
+	rcpts := []string{}
+	receiver := NewReceiver("127.0.0.1:0", func(in *Incoming) error {
+		mu.Lock()
+		defer mu.Unlock()
+		rcpts = append(rcpts, in.To...)
+		return nil
+	})
+	if err := receiver.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go receiver.Serve(ctx)
+
+	msg := ComposeMessage(Header{
+		From: "a@localhost",
+		To:   AddressList{{Address: "b@localhost"}, {Address: "invalid"}},
+		Cc:   AddressList{{Address: "c@localhost"}},
+	}, "content")
+
+	// the receiver rejects the empty address - the local part is empty after the '<>' check
+	msg.Header.Cc = append(msg.Header.Cc, Address{Address: ""})
+
+	results, err := New(receiver.Addr().String(), Auth{User: "user", Pass: "pass"}, nil, 1, 0).Send(context.Background(), msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{"b@localhost": true, "invalid": true, "c@localhost": true, "": false}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results - found: %v", len(expected), results)
+	}
+	for _, r := range results {
+		if accepted := r.Err == nil; accepted != expected[r.Recipient] {
+			t.Errorf("recipient: '%s' - expected accepted: %v, found error: %v", r.Recipient, expected[r.Recipient], r.Err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(rcpts, ",") != "b@localhost,invalid,c@localhost" {
+		t.Errorf("unexpected delivered recipients: %v", rcpts)
+	}
+}
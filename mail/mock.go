@@ -1,13 +1,25 @@
 package mail
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/section77/matterbot/logger"
 )
 
 // ServerMock implements the mail-system interface to use it in unit-tests
 type ServerMock struct {
+	mutex sync.Mutex
+
 	MailServerError error
-	Messages        []*Message
+	messages        []*Message
+
+	// recipients which are rejected from 'Send' (key: mail address)
+	Rejected map[string]error
+
+	// emulates a slow mail-server
+	SendDelay time.Duration
 }
 
 // NewMock instantiates a new ServerMock
@@ -18,24 +30,69 @@ func NewMock() *ServerMock {
 // SetMailServerError set's the error which should be returned
 // when the 'Send' function are called.
 func (mock *ServerMock) SetMailServerError(err error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
 	mock.MailServerError = err
 }
 
+// SetRejected set's the recipients which are rejected from 'Send'
+func (mock *ServerMock) SetRejected(rejected map[string]error) {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.Rejected = rejected
+}
+
 // Send emulates an send-action and saves all messages in the mock.
 // If the 'SetMailServerError' are called with an error, this function
-// returns the stored error.
-func (mock *ServerMock) Send(msg *Message, useTLS bool) error {
-	if mock.MailServerError == nil {
+// returns the stored error. The recipients in 'Rejected' are rejected
+// per result.
+// If the context is canceled while the 'SendDelay' elapses, the context
+// error is returned.
+func (mock *ServerMock) Send(ctx context.Context, msg *Message, useTLS bool) ([]Result, error) {
+	select {
+	case <-time.After(mock.SendDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+
+	if mock.MailServerError != nil {
+		logger.Debugf("mail-mock is configured to trigger an error - returning the error")
+		return nil, mock.MailServerError
+	}
+
+	results := []Result{}
+	accepted := false
+	for _, rcpt := range msg.Recipients() {
+		err := mock.Rejected[rcpt]
+		accepted = accepted || err == nil
+		results = append(results, Result{Recipient: rcpt, Err: err})
+	}
+
+	if accepted {
 		logger.Debugf("send per mail: %s", msg.Content)
-		mock.Messages = append(mock.Messages, msg)
-		return nil
+		mock.messages = append(mock.messages, msg)
 	}
+	return results, nil
+}
+
+// Close does nothing - the mock has no sessions
+func (mock *ServerMock) Close() error {
+	return nil
+}
 
-	logger.Debugf("mail-mock is configured to trigger an error - returning the error")
-	return mock.MailServerError
+// Messages returns a copy of the stored mail messages
+func (mock *ServerMock) Messages() []*Message {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	return append([]*Message{}, mock.messages...)
 }
 
 // ClearMessages removes all stored mail messages from the mock
 func (mock *ServerMock) ClearMessages() {
-	mock.Messages = nil
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	mock.messages = nil
 }
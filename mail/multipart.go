@@ -0,0 +1,118 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+)
+
+// Attachment is a file which is attached to a mail
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// max. line length of the base64 encoded attachments (https://tools.ietf.org/html/rfc2045#section-6.8)
+const base64LineLength = 76
+
+// AppendMultipart appends the content as multipart message:
+//
+//   - 'multipart/alternative' with the text and the html content, if the html isn't empty
+//   - 'multipart/mixed' with the content and the attachments, if there are attachments
+func (mb *messageContentBuilder) AppendMultipart(text, html string, attachments []Attachment) {
+	if len(attachments) == 0 {
+		contentType, body := alternativePart(text, html)
+		mb.AppendHeader("Content-type", contentType)
+		mb.AppendContent(body)
+		return
+	}
+
+	var buf bytes.Buffer
+	writer := newMultipartWriter(&buf)
+	mb.AppendHeader("Content-type", "multipart/mixed; boundary="+writer.Boundary())
+
+	// errors are not possible - the writer writes in a buffer
+	if html == "" {
+		writeTextPart(writer, "text/plain; charset=utf-8", text)
+	} else {
+		contentType, body := alternativePart(text, html)
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {contentType},
+		})
+		part.Write([]byte(body))
+	}
+
+	for _, a := range attachments {
+		params := map[string]string{"name": a.Name}
+		contentType := mime.FormatMediaType(a.ContentType, params)
+		if contentType == "" {
+			// missing or invalid content-type
+			contentType = mime.FormatMediaType("application/octet-stream", params)
+		}
+
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		part.Write(encodeBase64(a.Data))
+	}
+	writer.Close()
+
+	mb.AppendContent(buf.String())
+}
+
+// alternativePart returns the content-type and the body of a 'multipart/alternative'
+// part with the text and the html content
+func alternativePart(text, html string) (string, string) {
+	var buf bytes.Buffer
+	writer := newMultipartWriter(&buf)
+	writeTextPart(writer, "text/plain; charset=utf-8", text)
+	writeTextPart(writer, "text/html; charset=utf-8", html)
+	writer.Close()
+
+	return "multipart/alternative; boundary=" + writer.Boundary(), buf.String()
+}
+
+// writeTextPart writes the text as part - encoded per 'encodeText'
+func writeTextPart(writer *multipart.Writer, contentType, text string) {
+	encoding, body := encodeText(text)
+
+	// errors are not possible - the writer writes in a buffer
+	part, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {encoding},
+	})
+	part.Write([]byte(body))
+}
+
+// newBoundary returns the boundary of the multipart messages - fixed in the tests
+var newBoundary = func() string {
+	return multipart.NewWriter(nil).Boundary()
+}
+
+func newMultipartWriter(w io.Writer) *multipart.Writer {
+	writer := multipart.NewWriter(w)
+	// the boundary is valid - no error possible
+	writer.SetBoundary(newBoundary())
+	return writer
+}
+
+// encodeBase64 encodes the data in lines with 'base64LineLength' chars
+func encodeBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(encoded) > base64LineLength {
+		buf.WriteString(encoded[:base64LineLength])
+		buf.WriteString("\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,128 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestComposeMessageWithAttachments(t *testing.T) {
+	data := bytes.Repeat([]byte{0, 1, 2, 250}, 100)
+	msg := ComposeMessage(Header{From: "bot@example.com", To: AddressList{{Address: "ml@example.com"}}, Subject: "test"}, "see the files",
+		Attachment{Name: "data.bin", ContentType: "application/octet-stream", Data: data},
+		Attachment{Name: "Überblick.txt", Data: []byte("hello")},
+	)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected content-type: %s", parsed.Header.Get("Content-type"))
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	expected := []struct {
+		fileName    string
+		contentType string
+		content     []byte
+	}{
+		{"", "text/plain; charset=utf-8", []byte("see the files")},
+		{"data.bin", "application/octet-stream; name=data.bin", data},
+		{"Überblick.txt", "application/octet-stream; name*=utf-8''%C3%9Cberblick.txt", []byte("hello")},
+	}
+
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part: '%s' not found - error: %s", e.fileName, err.Error())
+		}
+
+		if part.FileName() != e.fileName || part.Header.Get("Content-Type") != e.contentType {
+			t.Errorf("unexpected part header: %v", part.Header)
+		}
+
+		var body io.Reader = part
+		if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+			body = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, e.content) {
+			t.Errorf("unexpected content in part: '%s'", e.fileName)
+		}
+	}
+
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("unexpected part - error: %v", err)
+	}
+
+	// the base64 encoded lines
+	for _, line := range strings.Split(msg.Body, "\r\n") {
+		if !strings.Contains(line, ":") && len(line) > base64LineLength {
+			t.Errorf("line too long: %s", line)
+		}
+	}
+}
+
+// without attachments, the mail should be a single text/plain message
+func TestComposeMessageWithoutAttachments(t *testing.T) {
+	msg := ComposeMessage(Header{From: "bot@example.com", To: AddressList{{Address: "ml@example.com"}}}, "content")
+	if !strings.Contains(msg.Body, "Content-type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 7bit\r\n\r\ncontent") {
+		t.Errorf("unexpected message: %s", msg.Body)
+	}
+}
+
+func TestComposeHTMLMessage(t *testing.T) {
+	html := "<p>" + strings.Repeat("<strong>long</strong> line ", 10) + "</p>"
+	msg := ComposeHTMLMessage(Header{From: "bot@example.com", To: AddressList{{Address: "ml@example.com"}}, Subject: "test"}, "long line", html)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content-type: %s", parsed.Header.Get("Content-type"))
+	}
+
+	// the preferred alternative is the last part
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for _, e := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", "long line"},
+		{"text/html; charset=utf-8", html},
+	} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part: '%s' not found - error: %s", e.contentType, err.Error())
+		}
+		if part.Header.Get("Content-Type") != e.contentType {
+			t.Errorf("unexpected part header: %v", part.Header)
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != e.content {
+			t.Errorf("part: '%s' - expected: %q, found: %q", e.contentType, e.content, content)
+		}
+	}
+
+	// the quoted-printable lines are wrapped - the header lines are not checked
+	for _, line := range strings.Split(msg.Body, "\r\n") {
+		if len(line) > 76 && !strings.Contains(line, ":") {
+			t.Errorf("line exceeds 76 characters: %q", line)
+		}
+	}
+}
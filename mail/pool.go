@@ -0,0 +1,177 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// timeout for the health check of an idle session and for the 'QUIT'
+const sessionCheckTimeout = 10 * time.Second
+
+// smtpSession is an open and authenticated smtp session
+type smtpSession struct {
+	con       net.Conn
+	client    *smtp.Client
+	useTLS    bool
+	idleSince time.Time
+}
+
+// quit closes the session per 'QUIT' - a hanging server is ignored after the timeout
+func (s *smtpSession) quit() {
+	s.con.SetDeadline(time.Now().Add(sessionCheckTimeout))
+	if err := s.client.Quit(); err != nil {
+		logger.Debugf("unable to quit the smtp session - %s", err.Error())
+	}
+	s.con.Close()
+}
+
+// check resets the session per 'RSET', or checks it per 'NOOP'
+func (s *smtpSession) check(reset bool) error {
+	s.con.SetDeadline(time.Now().Add(sessionCheckTimeout))
+	defer s.con.SetDeadline(time.Time{})
+
+	if reset {
+		return s.client.Reset()
+	}
+	return s.client.Noop()
+}
+
+// pool keeps the smtp sessions alive between the sends - the connect, the TLS
+// handshake and the login are only needed for a new session.
+//
+//   - a session is reset per 'RSET' after the send, and checked per 'NOOP'
+//     before it's reused - a broken session is replaced by a new session
+//   - an idle session is closed after the idle timeout
+//   - the number of sessions is limited - 'get' blocks while all sessions are in use
+type pool struct {
+	mutex  sync.Mutex
+	idle   []*smtpSession
+	closed bool
+
+	// a token per session in use
+	slots chan struct{}
+
+	idleTimeout time.Duration
+	connect     func(context.Context, bool) (*smtpSession, error)
+}
+
+// newPool instantiates a pool with max. 'size' sessions - min. one session
+func newPool(size int, idleTimeout time.Duration, connect func(context.Context, bool) (*smtpSession, error)) *pool {
+	if size < 1 {
+		size = 1
+	}
+	return &pool{
+		slots:       make(chan struct{}, size),
+		idleTimeout: idleTimeout,
+		connect:     connect,
+	}
+}
+
+// get returns an idle session, or a new session if no idle session is usable
+func (p *pool) get(ctx context.Context, useTLS bool) (*smtpSession, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for s := p.takeIdle(useTLS); s != nil; s = p.takeIdle(useTLS) {
+		if err := s.check(false); err != nil {
+			logger.Debugf("idle smtp session is broken - reconnect: %s", err.Error())
+			s.con.Close()
+			continue
+		}
+		logger.Debug("reuse idle smtp session")
+		return s, nil
+	}
+
+	s, err := p.connect(ctx, useTLS)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return s, nil
+}
+
+// put returns the session to the pool - a session with an error is closed
+func (p *pool) put(s *smtpSession, ok bool) {
+	defer func() { <-p.slots }()
+
+	if !ok {
+		s.con.Close()
+		return
+	}
+
+	if err := s.check(true); err != nil {
+		logger.Debugf("unable to reset the smtp session - %s", err.Error())
+		s.con.Close()
+		return
+	}
+
+	p.mutex.Lock()
+	if p.closed || p.idleTimeout <= 0 {
+		p.mutex.Unlock()
+		s.quit()
+		return
+	}
+	s.idleSince = time.Now()
+	p.idle = append(p.idle, s)
+	p.mutex.Unlock()
+
+	time.AfterFunc(p.idleTimeout, p.expire)
+}
+
+// takeIdle removes the most recently used idle session from the pool - expired
+// sessions, and sessions with the other protocol are closed
+func (p *pool) takeIdle(useTLS bool) *smtpSession {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for len(p.idle) > 0 {
+		s := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if s.useTLS == useTLS && time.Since(s.idleSince) < p.idleTimeout {
+			return s
+		}
+		go s.quit()
+	}
+	return nil
+}
+
+// expire closes the sessions which are idle since the idle timeout
+func (p *pool) expire() {
+	p.mutex.Lock()
+	expired := []*smtpSession{}
+	idle := p.idle[:0]
+	for _, s := range p.idle {
+		if time.Since(s.idleSince) >= p.idleTimeout {
+			expired = append(expired, s)
+		} else {
+			idle = append(idle, s)
+		}
+	}
+	p.idle = idle
+	p.mutex.Unlock()
+
+	for _, s := range expired {
+		logger.Debug("close idle smtp session")
+		s.quit()
+	}
+}
+
+// close closes the idle sessions - sessions in use are closed after the send
+func (p *pool) close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mutex.Unlock()
+
+	for _, s := range idle {
+		s.quit()
+	}
+}
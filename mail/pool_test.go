@@ -0,0 +1,171 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingListener counts the accepted connections
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	con, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return con, err
+}
+
+// startTestReceiver starts a local smtp server - it counts the connections and the received mails
+func startTestReceiver(tb testing.TB) (string, *countingListener, *int32, func()) {
+	var received int32
+	receiver := NewReceiver("127.0.0.1:0", func(in *Incoming) error {
+		atomic.AddInt32(&received, 1)
+		return nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	counting := &countingListener{Listener: listener}
+	receiver.listener = counting
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go receiver.Serve(ctx)
+	return listener.Addr().String(), counting, &received, cancel
+}
+
+func testMessage() *Message {
+	return ComposeMessage(Header{From: "a@localhost", To: AddressList{{Address: "b@localhost"}}}, "content")
+}
+
+// the mails should be sent per one session
+func TestSendReusesSessions(t *testing.T) {
+	addr, listener, received, stop := startTestReceiver(t)
+	defer stop()
+
+	server := New(addr, Auth{User: "user", Pass: "pass"}, nil, 1, time.Minute)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.Send(context.Background(), testMessage(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(received); n != 3 {
+		t.Errorf("expected 3 received mails, found: %d", n)
+	}
+	if n := atomic.LoadInt32(&listener.accepted); n != 1 {
+		t.Errorf("expected one connection, found: %d", n)
+	}
+}
+
+// a broken idle session should be replaced by a new session
+func TestSendReconnectsBrokenSessions(t *testing.T) {
+	addr, listener, received, stop := startTestReceiver(t)
+	defer stop()
+
+	server := New(addr, Auth{User: "user", Pass: "pass"}, nil, 1, time.Minute)
+	defer server.Close()
+	p := server.(*serverImpl).pool
+
+	if _, err := server.Send(context.Background(), testMessage(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// emulates a connection which was closed from the mail-server
+	p.mutex.Lock()
+	p.idle[0].con.Close()
+	p.mutex.Unlock()
+
+	if _, err := server.Send(context.Background(), testMessage(), false); err != nil {
+		t.Fatalf("the broken session should be replaced - error: %s", err.Error())
+	}
+	if n := atomic.LoadInt32(received); n != 2 {
+		t.Errorf("expected 2 received mails, found: %d", n)
+	}
+	if n := atomic.LoadInt32(&listener.accepted); n != 2 {
+		t.Errorf("expected 2 connections, found: %d", n)
+	}
+}
+
+// idle sessions should be closed after the idle timeout
+func TestPoolClosesIdleSessions(t *testing.T) {
+	addr, _, _, stop := startTestReceiver(t)
+	defer stop()
+
+	server := New(addr, Auth{User: "user", Pass: "pass"}, nil, 1, 50*time.Millisecond)
+	defer server.Close()
+	p := server.(*serverImpl).pool
+
+	if _, err := server.Send(context.Background(), testMessage(), false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle) != 0 {
+		t.Errorf("expected no idle sessions after the timeout, found: %d", len(p.idle))
+	}
+}
+
+// concurrent sends should share the limited sessions
+func TestPoolLimitsSessions(t *testing.T) {
+	addr, listener, received, stop := startTestReceiver(t)
+	defer stop()
+
+	server := New(addr, Auth{User: "user", Pass: "pass"}, nil, 2, time.Minute)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := server.Send(context.Background(), testMessage(), false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(received); n != 10 {
+		t.Errorf("expected 10 received mails, found: %d", n)
+	}
+	if n := atomic.LoadInt32(&listener.accepted); n > 2 {
+		t.Errorf("expected max. 2 connections, found: %d", n)
+	}
+}
+
+func benchmarkSend(b *testing.B, idleTimeout time.Duration) {
+	addr, _, _, stop := startTestReceiver(b)
+	defer stop()
+
+	server := New(addr, Auth{User: "user", Pass: "pass"}, nil, 1, idleTimeout)
+	defer server.Close()
+	msg := testMessage()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.Send(context.Background(), msg, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendPooled(b *testing.B) {
+	benchmarkSend(b, time.Minute)
+}
+
+func BenchmarkSendWithoutPool(b *testing.B) {
+	benchmarkSend(b, 0)
+}
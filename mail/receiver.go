@@ -0,0 +1,237 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// max. size of a received mail
+const maxReceiveSize = 10 << 20
+
+// timeout per smtp command - the connection is closed after the timeout
+const receiveTimeout = 5 * time.Minute
+
+// ErrTryLater is returned from a receive handler, if the mail can't be handled
+// now - the sender is asked to try it later
+var ErrTryLater = errors.New("try later")
+
+// Receiver is a small smtp / lmtp server - like for the replies to the forwarded mails.
+//
+//   - lmtp is used if the client greets per 'LHLO' - with a reply per recipient after 'DATA'
+//   - the handler is called for each mail - an error rejects the mail. errors
+//     per 'ErrTryLater' are temporary.
+//   - there is no authentication and no TLS - run it in a trusted network, or
+//     behind a mail-server which delivers the replies per smtp / lmtp
+type Receiver struct {
+	addr     string
+	handler  func(*Incoming) error
+	listener net.Listener
+}
+
+// NewReceiver instantiates a receiver which listens on the given address
+func NewReceiver(addr string, handler func(*Incoming) error) *Receiver {
+	return &Receiver{addr: addr, handler: handler}
+}
+
+// Listen opens the listener - the connections are accepted per 'Serve'
+func (r *Receiver) Listen() error {
+	listener, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on: %s - %s", r.addr, err.Error())
+	}
+	r.listener = listener
+	return nil
+}
+
+// Addr returns the address of the listener
+func (r *Receiver) Addr() net.Addr {
+	return r.listener.Addr()
+}
+
+// Serve accepts the connections until the context is canceled
+func (r *Receiver) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		r.listener.Close()
+	}()
+
+	for {
+		con, err := r.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go r.serve(con)
+	}
+}
+
+// session is the state of a smtp / lmtp session
+type session struct {
+	lmtp bool
+	from string
+	to   []string
+}
+
+func (r *Receiver) serve(con net.Conn) {
+	defer con.Close()
+
+	hostname, _ := os.Hostname()
+	text := textproto.NewConn(con)
+	reply := func(format string, xs ...interface{}) bool {
+		return text.PrintfLine(format, xs...) == nil
+	}
+
+	if !reply("220 %s matterbot ESMTP ready", hostname) {
+		return
+	}
+
+	s := &session{}
+	for {
+		con.SetDeadline(time.Now().Add(receiveTimeout))
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		ok := true
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "LHLO":
+			*s = session{lmtp: strings.EqualFold(cmd, "LHLO")}
+			ok = reply("250-%s", hostname) && reply("250-8BITMIME") && reply("250-PIPELINING") &&
+				reply("250 SIZE %d", maxReceiveSize)
+		case "HELO":
+			*s = session{}
+			ok = reply("250 %s", hostname)
+		case "MAIL":
+			addr, valid := pathArg(arg, "FROM:")
+			if !valid {
+				ok = reply("501 5.5.4 syntax: MAIL FROM:<address>")
+				break
+			}
+			*s = session{lmtp: s.lmtp, from: addr}
+			ok = reply("250 2.1.0 ok")
+		case "RCPT":
+			addr, valid := pathArg(arg, "TO:")
+			if !valid || addr == "" {
+				ok = reply("501 5.5.4 syntax: RCPT TO:<address>")
+				break
+			}
+			s.to = append(s.to, addr)
+			ok = reply("250 2.1.5 ok")
+		case "DATA":
+			if len(s.to) == 0 {
+				ok = reply("503 5.5.1 need RCPT before DATA")
+				break
+			}
+			if !reply("354 end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			ok = r.receive(s, text, reply)
+			*s = session{lmtp: s.lmtp}
+		case "RSET":
+			*s = session{lmtp: s.lmtp}
+			ok = reply("250 2.0.0 ok")
+		case "NOOP":
+			ok = reply("250 2.0.0 ok")
+		case "QUIT":
+			reply("221 2.0.0 bye")
+			return
+		default:
+			ok = reply("502 5.5.2 command not implemented")
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
+
+// receive reads the mail and calls the handler - the result is replied
+// once, or per recipient in a lmtp session
+func (r *Receiver) receive(s *session, text *textproto.Conn, reply func(string, ...interface{}) bool) bool {
+	dot := text.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(dot, maxReceiveSize+1))
+	if err != nil {
+		return false
+	}
+
+	var status string
+	if len(data) > maxReceiveSize {
+		// the rest of the mail must be read - before the reply
+		if _, err := io.Copy(ioutil.Discard, dot); err != nil {
+			return false
+		}
+		status = "552 5.3.4 message too big"
+	} else {
+		status = r.handle(s, data)
+	}
+
+	count := 1
+	if s.lmtp {
+		count = len(s.to)
+	}
+	for i := 0; i < count; i++ {
+		if !reply("%s", status) {
+			return false
+		}
+	}
+	return true
+}
+
+// handle parses the mail and calls the handler - it returns the smtp status
+func (r *Receiver) handle(s *session, data []byte) string {
+	in, err := ParseIncoming(s.from, s.to, data)
+	if err != nil {
+		logger.Infof("reject mail from: %s - %s", s.from, err.Error())
+		return "550 5.6.0 " + replyText(err)
+	}
+
+	if err := r.handler(in); err != nil {
+		if errors.Is(err, ErrTryLater) {
+			logger.Infof("defer mail from: %s - %s", s.from, err.Error())
+			return "451 4.3.0 " + replyText(err)
+		}
+		logger.Infof("reject mail from: %s - %s", s.from, err.Error())
+		return "550 5.7.1 " + replyText(err)
+	}
+	return "250 2.0.0 ok"
+}
+
+// pathArg returns the address from a 'FROM:<addr>' or 'TO:<addr>' argument - the
+// esmtp parameters (like 'SIZE=123') are ignored
+func pathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	path := strings.TrimSpace(arg[len(prefix):])
+	if i := strings.IndexByte(path, ' '); i >= 0 {
+		path = path[:i]
+	}
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+	return path[1 : len(path)-1], true
+}
+
+// replyText returns the error as single line for the smtp reply
+func replyText(err error) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+}
@@ -0,0 +1,138 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"testing"
+)
+
+// startReceiver starts a receiver on a random port - it's stopped per the returned function
+func startReceiver(t *testing.T, handler func(*Incoming) error) (string, func()) {
+	receiver := NewReceiver("127.0.0.1:0", handler)
+	if err := receiver.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go receiver.Serve(ctx)
+	return receiver.Addr().String(), cancel
+}
+
+func TestReceiverReceivesMails(t *testing.T) {
+	var mu sync.Mutex
+	received := []*Incoming{}
+	addr, stop := startReceiver(t, func(in *Incoming) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, in)
+		return nil
+	})
+	defer stop()
+
+	msg := "From: Alice <alice@example.com>\r\n" +
+		"To: matterbot@example.com\r\n" +
+		"Subject: Re: meeting\r\n" +
+		"In-Reply-To: <post-1@example.com>\r\n" +
+		"\r\n" +
+		"see you\r\n" +
+		".leading dot\r\n"
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"matterbot@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("expected one mail - found: %d", len(received))
+	}
+	in := received[0]
+	if in.From != "alice@example.com" || len(in.To) != 1 || in.To[0] != "matterbot@example.com" {
+		t.Errorf("unexpected envelope - from: %s, to: %v", in.From, in.To)
+	}
+	if in.Sender() != "Alice" || in.Header.Get("Subject") != "Re: meeting" {
+		t.Errorf("unexpected header: %v", in.Header)
+	}
+	if in.Text != "see you\n.leading dot\n" {
+		t.Errorf("unexpected text: %q", in.Text)
+	}
+}
+
+// the handler errors should be replied as permanent or temporary failures
+func TestReceiverRejectsMails(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{errors.New("unknown thread"), 550},
+		{fmt.Errorf("disconnected - %w", ErrTryLater), 451},
+	}
+
+	for _, test := range tests {
+		addr, stop := startReceiver(t, func(in *Incoming) error { return test.err })
+
+		err := smtp.SendMail(addr, nil, "alice@example.com", []string{"matterbot@example.com"}, []byte("Subject: x\r\n\r\ntext\r\n"))
+		var protoErr *textproto.Error
+		if !errors.As(err, &protoErr) || protoErr.Code != test.code {
+			t.Errorf("expected code: %d - found: %v", test.code, err)
+		}
+		stop()
+	}
+}
+
+// in a lmtp session, the result is replied per recipient
+func TestReceiverSpeaksLMTP(t *testing.T) {
+	addr, stop := startReceiver(t, func(in *Incoming) error { return nil })
+	defer stop()
+
+	con, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+
+	expect := func(code int) {
+		t.Helper()
+		if _, _, err := con.ReadResponse(code); err != nil {
+			t.Fatalf("expected code: %d - error: %s", code, err.Error())
+		}
+	}
+	send := func(line string, code int) {
+		t.Helper()
+		if err := con.PrintfLine("%s", line); err != nil {
+			t.Fatal(err)
+		}
+		expect(code)
+	}
+
+	expect(220)
+	send("LHLO localhost", 250)
+	send("MAIL FROM:<alice@example.com> SIZE=100", 250)
+	send("RCPT TO:<a@example.com>", 250)
+	send("RCPT TO:<b@example.com>", 250)
+	send("DATA", 354)
+	send("Subject: x\r\n\r\ntext\r\n.", 250)
+	expect(250)
+	send("QUIT", 221)
+}
+
+func TestPathArg(t *testing.T) {
+	tests := []struct {
+		arg, prefix, addr string
+		valid             bool
+	}{
+		{"FROM:<alice@example.com>", "FROM:", "alice@example.com", true},
+		{"from: <alice@example.com> SIZE=123", "FROM:", "alice@example.com", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"TO:<b@example.com>", "FROM:", "", false},
+		{"FROM:alice@example.com", "FROM:", "", false},
+	}
+	for _, test := range tests {
+		if addr, valid := pathArg(test.arg, test.prefix); addr != test.addr || valid != test.valid {
+			t.Errorf("arg: %q - expected: %q (%v), found: %q (%v)", test.arg, test.addr, test.valid, addr, valid)
+		}
+	}
+}
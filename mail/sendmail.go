@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// NewSendmail instantiates the mail-system for the local sendmail binary - like
+// '/usr/sbin/sendmail'. the message is piped to 'sendmail -t -i'.
+func NewSendmail(path string) Server {
+	return &sendmailServer{path: path}
+}
+
+type sendmailServer struct {
+	path string
+}
+
+// Send pipes the message to sendmail - the 'useTLS' flag is ignored.
+//
+// sendmail reads the recipients from the header, so the 'Bcc' recipients are
+// added per 'Bcc' header - sendmail removes the header before the delivery.
+// sendmail accepts all recipients, or fails.
+func (s *sendmailServer) Send(ctx context.Context, msg *Message, useTLS bool) ([]Result, error) {
+	logger.Debugf("send mail per sendmail: %s - from: %s, to: %v", s.path, msg.Header.From, msg.Recipients())
+
+	body := msg.Body
+	if len(msg.Header.Bcc) > 0 {
+		body = foldHeader("Bcc", msg.Header.Bcc.format()) + "\r\n" + body
+	}
+
+	cmd := exec.CommandContext(ctx, s.path, "-t", "-i", "-f", msg.Header.From)
+	cmd.Stdin = strings.NewReader(localLines(body))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("sendmail failed: %s - %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return acceptAll(msg), nil
+}
+
+// Close does nothing - sendmail is started per send
+func (s *sendmailServer) Close() error {
+	return nil
+}
+
+// localLines converts the line breaks of the mail to the local '\n' - for
+// sendmail and the mail files
+func localLines(body string) string {
+	return strings.ReplaceAll(body, "\r\n", "\n")
+}
+
+// acceptAll returns the results for a transport which delivers to all
+// recipients, or fails
+func acceptAll(msg *Message) []Result {
+	results := []Result{}
+	for _, rcpt := range msg.Recipients() {
+		results = append(results, Result{Recipient: rcpt})
+	}
+	return results
+}
@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFakeSendmail writes a script, which saves the arguments and the mail in the dir
+func writeFakeSendmail(t *testing.T, dir, script string) string {
+	path := filepath.Join(dir, "sendmail")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSendPerSendmail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-sendmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sendmail := writeFakeSendmail(t, dir, `echo "$@" > "$(dirname "$0")/args"; cat > "$(dirname "$0")/mail"`)
+	msg := ComposeMessage(Header{
+		From: "a@localhost",
+		To:   AddressList{{Address: "b@localhost"}},
+		Bcc:  AddressList{{Address: "c@localhost"}},
+	}, "content")
+
+	results, err := NewSendmail(sendmail).Send(context.Background(), msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Err != nil || results[1].Err != nil {
+		t.Errorf("unexpected results: %v", results)
+	}
+
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if strings.TrimSpace(string(args)) != "-t -i -f a@localhost" {
+		t.Errorf("unexpected arguments: %s", args)
+	}
+
+	mail, _ := ioutil.ReadFile(filepath.Join(dir, "mail"))
+	if !strings.HasPrefix(string(mail), "Bcc: c@localhost\n") || !strings.Contains(string(mail), "To: b@localhost\n") {
+		t.Errorf("the mail should have the recipients in the header: %s", mail)
+	}
+	if strings.Contains(string(mail), "\r") {
+		t.Errorf("the mail should have local line breaks: %q", mail)
+	}
+}
+
+func TestSendPerSendmailFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-sendmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sendmail := writeFakeSendmail(t, dir, `cat > /dev/null; echo "queue full" >&2; exit 75`)
+	_, err = NewSendmail(sendmail).Send(context.Background(), testMessage(), false)
+	if err == nil || !strings.Contains(err.Error(), "queue full") {
+		t.Errorf("expected the error from sendmail, found: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package mail
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// STARTTLS policies for 'TLSOptions.StartTLS'
+const (
+	// the session fails if the server doesn't offer STARTTLS
+	StartTLSRequired = "required"
+	// the session is upgraded if the server offers STARTTLS - plain text otherwise
+	StartTLSOpportunistic = "opportunistic"
+	// the session is never upgraded
+	StartTLSOff = "off"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions are the settings for the encrypted connections to the mail-server
+type TLSOptions struct {
+	// PEM file with the trusted CAs - the system CAs are used if empty
+	CAFile string
+
+	// PEM files with the client certificate and the key - optional
+	CertFile string
+	KeyFile  string
+
+	// min. TLS version: '1.0', '1.1', '1.2' or '1.3' - '1.2' if empty
+	MinVersion string
+
+	// name for the certificate check - the host of the mail-server if empty
+	ServerName string
+
+	// one of the 'StartTLS*' policies - 'StartTLSOpportunistic' if empty. it's
+	// ignored if the connection is encrypted per TLS from the start.
+	StartTLS string
+}
+
+// TLS are the loaded settings for the encrypted connections - see 'LoadTLS'
+type TLS struct {
+	config     *tls.Config
+	serverName string
+	startTLS   string
+}
+
+// LoadTLS checks the options and loads the CAs and the client certificate
+func LoadTLS(opts TLSOptions) (*TLS, error) {
+	t := &TLS{
+		config:     &tls.Config{MinVersion: tls.VersionTLS12},
+		serverName: opts.ServerName,
+		startTLS:   strings.ToLower(opts.StartTLS),
+	}
+
+	switch t.startTLS {
+	case "":
+		t.startTLS = StartTLSOpportunistic
+	case StartTLSRequired, StartTLSOpportunistic, StartTLSOff:
+	default:
+		return nil, fmt.Errorf("unknown STARTTLS policy: '%s' - expected one of: required, opportunistic or off", opts.StartTLS)
+	}
+
+	if opts.MinVersion != "" {
+		version, found := tlsVersions[opts.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown TLS version: '%s' - expected one of: 1.0, 1.1, 1.2 or 1.3", opts.MinVersion)
+		}
+		t.config.MinVersion = version
+	}
+
+	if opts.CAFile != "" {
+		buf, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA file - %s", err.Error())
+		}
+		t.config.RootCAs = x509.NewCertPool()
+		if !t.config.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates in the CA file: %s", opts.CAFile)
+		}
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("the client certificate needs the certificate and the key file")
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate - %s", err.Error())
+		}
+		t.config.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// defaultTLS are the settings if no settings are given - the system CAs and
+// opportunistic STARTTLS
+var defaultTLS = &TLS{
+	config:   &tls.Config{MinVersion: tls.VersionTLS12},
+	startTLS: StartTLSOpportunistic,
+}
+
+// clientConfig returns the TLS config for a connection to the given host
+func (t *TLS) clientConfig(host string) *tls.Config {
+	config := t.config.Clone()
+	config.ServerName = host
+	if t.serverName != "" {
+		config.ServerName = t.serverName
+	}
+	return config
+}
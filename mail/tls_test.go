@@ -0,0 +1,250 @@
+package mail
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCA is a private CA for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "matterbot test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for the given name - the cert and the key as PEM
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// startTLSReceiver starts a local smtp server per TLS - the server requires a client certificate
+func startTLSReceiver(t *testing.T, ca *testCA, maxVersion uint16) (string, func()) {
+	certPEM, keyPEM := ca.issue(t, "mail.test", x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewReceiver("127.0.0.1:0", func(in *Incoming) error { return nil })
+	receiver.listener = tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MaxVersion:   maxVersion,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go receiver.Serve(ctx)
+	return listener.Addr().String(), cancel
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// the mail-server should be verified per private CA, and the client per client certificate
+func TestSendPerTLSWithPrivateCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "matterbot", x509.ExtKeyUsageClientAuth)
+	opts := TLSOptions{
+		CAFile:     writeTestFile(t, dir, "ca.pem", ca.pem),
+		CertFile:   writeTestFile(t, dir, "cert.pem", certPEM),
+		KeyFile:    writeTestFile(t, dir, "key.pem", keyPEM),
+		ServerName: "mail.test",
+	}
+
+	addr, stop := startTLSReceiver(t, ca, tls.VersionTLS13)
+	defer stop()
+
+	send := func(opts TLSOptions) error {
+		tlsSettings, err := LoadTLS(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = New(addr, Auth{}, tlsSettings, 1, 0).Send(context.Background(), testMessage(), true)
+		return err
+	}
+
+	if err := send(opts); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	withoutCA := opts
+	withoutCA.CAFile = ""
+	if err := send(withoutCA); err == nil {
+		t.Errorf("the certificate of the private CA shouldn't be trusted without the CA file")
+	}
+
+	wrongName := opts
+	wrongName.ServerName = "other.test"
+	if err := send(wrongName); err == nil {
+		t.Errorf("the certificate shouldn't be valid for another server name")
+	}
+
+	withoutCert := opts
+	withoutCert.CertFile, withoutCert.KeyFile = "", ""
+	if err := send(withoutCert); err == nil {
+		t.Errorf("the server should reject the client without certificate")
+	}
+}
+
+// the connection should fail if the server doesn't support the min. version
+func TestSendWithMinTLSVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "matterbot", x509.ExtKeyUsageClientAuth)
+	addr, stop := startTLSReceiver(t, ca, tls.VersionTLS12)
+	defer stop()
+
+	tlsSettings, err := LoadTLS(TLSOptions{
+		CAFile:     writeTestFile(t, dir, "ca.pem", ca.pem),
+		CertFile:   writeTestFile(t, dir, "cert.pem", certPEM),
+		KeyFile:    writeTestFile(t, dir, "key.pem", keyPEM),
+		ServerName: "mail.test",
+		MinVersion: "1.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(addr, Auth{}, tlsSettings, 1, 0).Send(context.Background(), testMessage(), true); err == nil {
+		t.Errorf("expected an error - the server supports only TLS 1.2")
+	}
+}
+
+// with 'required', a server without STARTTLS should fail the send
+func TestStartTLSPolicy(t *testing.T) {
+	addr, _, received, stop := startTestReceiver(t)
+	defer stop()
+
+	tests := []struct {
+		policy string
+		ok     bool
+	}{
+		{StartTLSRequired, false},
+		{StartTLSOpportunistic, true},
+		{StartTLSOff, true},
+	}
+	for _, test := range tests {
+		tlsSettings, err := LoadTLS(TLSOptions{StartTLS: test.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = New(addr, Auth{}, tlsSettings, 1, 0).Send(context.Background(), testMessage(), false)
+		if (err == nil) != test.ok {
+			t.Errorf("policy: %s - expected success: %v, error: %v", test.policy, test.ok, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "STARTTLS") {
+			t.Errorf("policy: %s - the error should mention STARTTLS: %s", test.policy, err.Error())
+		}
+	}
+
+	if n := atomic.LoadInt32(received); n != 2 {
+		t.Errorf("expected 2 received mails, found: %d", n)
+	}
+}
+
+func TestLoadTLSErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		opts     TLSOptions
+		expected string
+	}{
+		{"unknown policy", TLSOptions{StartTLS: "always"}, "unknown STARTTLS policy: 'always'"},
+		{"unknown version", TLSOptions{MinVersion: "1.4"}, "unknown TLS version: '1.4'"},
+		{"missing CA file", TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, "unable to read the CA file"},
+		{"invalid CA file", TLSOptions{CAFile: writeTestFile(t, dir, "invalid.pem", []byte("no pem"))}, "no certificates in the CA file"},
+		{"cert without key", TLSOptions{CertFile: "cert.pem"}, "needs the certificate and the key file"},
+	}
+
+	for _, test := range tests {
+		if _, err := LoadTLS(test.opts); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error: '%s', found: %v", test.name, test.expected, err)
+		}
+	}
+}
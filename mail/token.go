@@ -0,0 +1,114 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource returns the access token for the 'xoauth2' authentication
+type TokenSource interface {
+	Token(context.Context) (string, error)
+}
+
+// the token is refreshed before it expires
+const tokenExpiryMargin = time.Minute
+
+// TokenFile returns a token source, which reads the token from the given file - the
+// file is read for each new session, so it can be refreshed from an external tool
+func TokenFile(path string) TokenSource {
+	return tokenFile(path)
+}
+
+type tokenFile string
+
+func (f tokenFile) Token(ctx context.Context) (string, error) {
+	buf, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return "", fmt.Errorf("empty token file: %s", string(f))
+	}
+	return token, nil
+}
+
+// TokenEndpoint returns a token source, which gets the access token per refresh
+// token from the oauth2 token endpoint - the token is cached until it expires
+func TokenEndpoint(endpoint, clientID, clientSecret, refreshToken string) TokenSource {
+	return &tokenEndpoint{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		refreshToken: refreshToken,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type tokenEndpoint struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	refreshToken string
+	client       *http.Client
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (e *tokenEndpoint) Token(ctx context.Context) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.token != "" && time.Now().Before(e.expires) {
+		return e.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {e.refreshToken},
+		"client_id":     {e.clientID},
+		"client_secret": {e.clientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid token response (status: %s) - %s", res.Status, err.Error())
+	}
+	if res.StatusCode != http.StatusOK || body.AccessToken == "" {
+		if body.Error != "" {
+			return "", fmt.Errorf("token refresh failed (status: %s) - %s", res.Status, body.Error)
+		}
+		return "", errors.New("token refresh failed - status: " + res.Status)
+	}
+
+	// a token without expiry is refreshed for each new session
+	e.token = body.AccessToken
+	e.expires = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return e.token, nil
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/namsral/flag"
 
 	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/dedup"
 	"github.com/section77/matterbot/logger"
 	"github.com/section77/matterbot/mail"
+	"github.com/section77/matterbot/outbox"
 )
 
 // flags
@@ -22,14 +31,55 @@ var (
 
 	showVersion = flag.Bool("v", false, "show version and exit")
 
+	reconnectMinDelay    = flag.Duration("reconnect-min-delay", 1*time.Second, "delay before the first reconnect - doubles after each failed attempt")
+	reconnectMaxDelay    = flag.Duration("reconnect-max-delay", 2*time.Minute, "max. delay between reconnect attempts")
+	reconnectMaxAttempts = flag.Int("reconnect-max-attempts", 0, "exit after this number of failed reconnect attempts - unlimited if 0")
+	reconnectMaxDowntime = flag.Duration("reconnect-max-downtime", 0, "exit if the chat-server is unreachable for this duration - unlimited if 0")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "max. time to wait for mail sends in progress on shutdown")
+
+	configFile = flag.String("config-file", "", "yaml config file - flags and environment variables overrides the config file")
+
 	mattermostURL  = flag.String("mattermost-url", "http://127.0.0.1:8065", "mattermost url")
 	mattermostUser = flag.String("mattermost-user", "matterbot", "mattermost user")
 	mattermostPass = flag.String("mattermost-pass", "tobrettam", "mattermost password")
 
-	mailHost   = flag.String("mail-host", "127.0.0.1:25", "mail-server host")
-	mailUser   = flag.String("mail-user", "matterbot@localhost", "mail login user")
-	mailPass   = flag.String("mail-pass", "tobrettam", "mail login pass")
-	mailUseTLS = flag.Bool("mail-use-tls", false, "use TLS instead of STARTTLS")
+	mattermostToken     = flag.String("mattermost-token", "", "personal access token or bot-account token - replaces the login with user / password")
+	mattermostTokenFile = flag.String("mattermost-token-file", "", "file with the access token - see '-mattermost-token'")
+
+	mailTransport = flag.String("mail-transport", "", "mail transport url: 'smtp://host:port', 'sendmail:///usr/sbin/sendmail', 'lmtp:///run/lmtp.sock', 'lmtp://host:port', 'maildir:///path/to/maildir' or 'mbox:///path/to/file' - smtp per '-mail-host' if empty")
+
+	mailHost        = flag.String("mail-host", "127.0.0.1:25", "mail-server host")
+	mailUser        = flag.String("mail-user", "matterbot@localhost", "mail login user")
+	mailFromName    = flag.String("mail-from-name", "", "display name of the sender - like 'Matterbot'")
+	mailPass        = flag.String("mail-pass", "tobrettam", "mail login pass")
+	mailUseTLS      = flag.Bool("mail-use-tls", false, "use TLS instead of STARTTLS")
+	mailReplyTo     = flag.String("mail-reply-to", "", "address for replies to the forwarded mails - the signed post id is added as tag: 'matterbot+<post-id>.<signature>@example.com'")
+	mailReplySecret = flag.String("mail-reply-secret", "", "secret to sign the tag of the '-mail-reply-to' address - required with '-mail-reply-to'")
+
+	mailStartTLS      = flag.String("mail-starttls", mail.StartTLSOpportunistic, "STARTTLS policy: required, opportunistic or off - 'required' fails if the mail-server doesn't offer STARTTLS")
+	mailTLSCAFile     = flag.String("mail-tls-ca-file", "", "PEM file with the trusted CAs for the mail-server - the system CAs if empty")
+	mailTLSCert       = flag.String("mail-tls-cert", "", "PEM file with the client certificate for the mail-server")
+	mailTLSKey        = flag.String("mail-tls-key", "", "PEM file with the key of the client certificate")
+	mailTLSMinVersion = flag.String("mail-tls-min-version", "1.2", "min. TLS version: 1.0, 1.1, 1.2 or 1.3")
+	mailTLSServerName = flag.String("mail-tls-server-name", "", "server name for the certificate check - the host of '-mail-host' if empty")
+
+	mailAuth              = flag.String("mail-auth", mail.AuthAuto, "smtp authentication: auto, plain, login, cram-md5, xoauth2 or none - 'auto' negotiates the mechanism from the EHLO extensions")
+	mailOAuthTokenFile    = flag.String("mail-oauth-token-file", "", "file with the access token for 'xoauth2' - read for each new smtp session")
+	mailOAuthTokenURL     = flag.String("mail-oauth-token-url", "", "oauth2 token endpoint - the access token for 'xoauth2' is refreshed per '-mail-oauth-refresh-token'")
+	mailOAuthClientID     = flag.String("mail-oauth-client-id", "", "oauth2 client id for the token endpoint")
+	mailOAuthClientSecret = flag.String("mail-oauth-client-secret", "", "oauth2 client secret for the token endpoint")
+	mailOAuthRefreshToken = flag.String("mail-oauth-refresh-token", "", "oauth2 refresh token for the token endpoint")
+
+	mailPoolSize = flag.Int("mail-pool-size", 2, "max. number of concurrent smtp sessions")
+	mailPoolIdle = flag.Duration("mail-pool-idle", time.Minute, "how long an idle smtp session is kept open for the next mail - zero closes each session after the send")
+
+	replyListen = flag.String("reply-listen", "", "address of the smtp / lmtp receiver, which posts the replies to forwarded mails in the chat - like ':2525' - disabled if empty")
+
+	mailHTML         = flag.Bool("mail-html", false, "send html mails with a text alternative - both rendered from the markdown of the message")
+	mailHTMLTemplate = flag.String("mail-html-template", "{{.Content}}", "mail html body - '{{.Content}}' is the rendered and sanitized html")
+
+	mailAttachmentLimit = flag.Int("mail-attachment-limit", 10<<20, "max. size of all attachments of a mail in bytes - other files are sent as public links")
 
 	mailSubject = flag.String("mail-subject",
 		"mattermost: {{.User}} writes in channel {{.Channel}}",
@@ -38,12 +88,27 @@ var (
 		"{{.Content}}",
 		"mail body")
 
+	outboxDir         = flag.String("outbox-dir", "spool", "directory for the outbox with undelivered mails - disabled if empty")
+	outboxMaxAttempts = flag.Int("outbox-max-attempts", 10, "number of delivery attempts before a mail is given up")
+	outboxRetryDelay  = flag.Duration("outbox-retry-delay", 30*time.Second, "delay before the first retry - doubles after each attempt")
+
+	dedupFile = flag.String("dedup-file", "spool/dedup.json", "file to remember the forwarded messages - disabled if empty")
+	dedupTTL  = flag.Duration("dedup-ttl", 7*24*time.Hour, "how long a forwarded message is remembered")
+
+	allowTeams    = flag.String("allow-teams", "", "forward only messages from these teams (and '-allow-channels'). example: 'team1,team2'")
+	denyTeams     = flag.String("deny-teams", "", "never forward messages from these teams")
+	allowChannels = flag.String("allow-channels", "", "forward only messages from these channels (and '-allow-teams'). example: 'team1/announcements'")
+	denyChannels  = flag.String("deny-channels", "", "never forward messages from these channels")
+
+	markerMode = flag.String("marker-mode", markerModePrefix, "where markers are accepted: 'prefix' - at the start of the message, 'anywhere' - as whole words anywhere in the message")
+
 	forward = flag.String("forward", "",
 		"mapping from marker to receiver mail address. example: 'user1=user1@gmail.com,user2=abc@mail.com'")
 )
 
-var mailSubjectTemplate *template.Template
-var mailBodyTemplate *template.Template
+// flags which are set per command line or environment variable - they
+// overrides the settings from the config file
+var explicitFlags = map[string]bool{}
 
 var version string
 
@@ -82,6 +147,25 @@ func main() {
 		os.Exit(0)
 	}
 
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	saveFlagDefaults()
+	var cfg *config
+	if len(*configFile) > 0 {
+		var err error
+		if cfg, err = readConfig(*configFile); err != nil {
+			logger.Errorf("invalid config file - error: %s", err.Error())
+			os.Exit(1)
+		}
+
+		if err = cfg.apply(); err != nil {
+			logger.Errorf("invalid config file - error: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	if *logVerbose {
 		logger.SetLogLevel(logger.DebugLevel)
 	} else if *logDisabled {
@@ -94,67 +178,414 @@ func main() {
 		os.Exit(1)
 	}
 
-	mailServer := mail.New(*mailHost, *mailUser, *mailPass)
+	if len(*mattermostTokenFile) > 0 {
+		token, err := readTokenFile(*mattermostTokenFile)
+		if err != nil {
+			logger.Errorf("invalid mattermost-token-file - error: %s", err.Error())
+			os.Exit(1)
+		}
+		*mattermostToken = token
+	}
 
-	if len(*forward) == 0 {
-		println("flag '-forward' are mandatory - see usage with the '-h' flag")
+	auth := mailAuthSettings()
+	if err := auth.Validate(); err != nil {
+		logger.Errorf("invalid mail-auth - error: %s", err.Error())
 		os.Exit(1)
 	}
-	fwdMappings, err := parseFwdMappings(*forward)
+	tlsSettings, err := mail.LoadTLS(mail.TLSOptions{
+		CAFile:     *mailTLSCAFile,
+		CertFile:   *mailTLSCert,
+		KeyFile:    *mailTLSKey,
+		MinVersion: *mailTLSMinVersion,
+		ServerName: *mailTLSServerName,
+		StartTLS:   *mailStartTLS,
+	})
 	if err != nil {
-		logger.Errorf("unable to parse flag 'forward'. error: %s", err.Error())
+		logger.Errorf("invalid mail tls settings - error: %s", err.Error())
 		os.Exit(1)
 	}
+	mailServer, err := newMailServer(auth, tlsSettings)
+	if err != nil {
+		logger.Errorf("invalid mail-transport - error: %s", err.Error())
+		os.Exit(1)
+	}
+
+	if len(*outboxDir) > 0 {
+		if mailOutbox, err = outbox.New(*outboxDir, *outboxMaxAttempts, *outboxRetryDelay); err != nil {
+			logger.Errorf("unable to open the outbox - error: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if len(*dedupFile) > 0 {
+		if forwarded, err = dedup.New(*dedupFile, *dedupTTL); err != nil {
+			logger.Errorf("unable to open the dedup store - error: %s", err.Error())
+			os.Exit(1)
+		}
+	}
 
-	if mailSubjectTemplate, err = template.New("mail-subject").Parse(*mailSubject); err != nil {
-		logger.Errorf("invalid template for mail-subject - error: %s", err.Error())
+	if len(*mailReplyTo) > 0 && len(*mailReplySecret) == 0 {
+		logger.Error("the '-mail-reply-to' address needs a '-mail-reply-secret' to sign the tag")
+		os.Exit(1)
+	}
+	if len(*replyListen) > 0 && forwarded == nil {
+		logger.Error("the reply receiver needs the '-dedup-file' - only replies to forwarded messages are accepted")
 		os.Exit(1)
 	}
-	if mailBodyTemplate, err = template.New("mail-body").Parse(*mailBody); err != nil {
-		logger.Errorf("invalid template for mail-body - error: %s", err.Error())
+
+	fwdConfig, err := newForwardConfig(cfg)
+	if err != nil {
+		logger.Errorf("%s - see usage with the '-h' flag", err.Error())
 		os.Exit(1)
 	}
+	liveFwdConfig := newLiveConfig(fwdConfig)
+	go watchReload(liveFwdConfig)
 
 	//
 	// "main loop"
 	//
 	//   * connect to mattermost
 	//   * call 'dispatch' with forwards the messages if their contains a marker
-	//   * if an error orccurs, reconnect to the mattermost server
+	//   * if an error orccurs, reconnect to the mattermost server with an exponential backoff
+	//     ('dispatch' backfills the messages which are posted while disconnected)
+	//   * exit if the max. reconnect attempts or the max. downtime is reached
+	//   * on SIGTERM / SIGINT: stop taking new messages, wait for the mail sends
+	//     in progress (max. 'shutdown-timeout') and exit
 	logger.Infof("startup - matterbot: v%s", version)
+	if len(*mattermostToken) > 0 {
+		logger.Infof("authenticate at %s per access token", url)
+	} else {
+		logger.Infof("authenticate at %s per login with user: %s", url, *mattermostUser)
+	}
+	ctx := shutdownOnSignal()
+
+	replies := &replyRelay{}
+	if len(*replyListen) > 0 {
+		receiver := mail.NewReceiver(*replyListen, replies.handle)
+		if err := receiver.Listen(); err != nil {
+			logger.Errorf("unable to start the reply receiver - error: %s", err.Error())
+			os.Exit(1)
+		}
+		logger.Infof("receive replies per smtp / lmtp at: %s", receiver.Addr())
+		go func() {
+			if err := receiver.Serve(ctx); err != nil {
+				logger.Errorf("reply receiver stopped - error: %s", err.Error())
+			}
+		}()
+	}
+
+	retry := newReconnectBackoff(*reconnectMinDelay, *reconnectMaxDelay)
+	scopesChecked := false
 	for {
 		logger.Info("connect to chat-server ...")
-		chatServer, err := chat.Connect(url, *mattermostUser, *mattermostPass)
+		chatServer, err := connect(url)
 		if err != nil {
 			logger.Error(err.Error())
-			time.Sleep(2 * time.Second)
 		} else {
 			logger.Info("connected to chatServer")
-			if err := dispatch(chatServer, mailServer, fwdMappings); err != nil {
+
+			// an unresolved deny-list entry is fatal on the first connect - later
+			// (e.g. a renamed team) the scope denies all messages
+			if !scopesChecked {
+				if _, err := resolveScopes(chatServer, liveFwdConfig.load()); err != nil {
+					logger.Errorf("invalid scope - error: %s", err.Error())
+					os.Exit(1)
+				}
+				scopesChecked = true
+			}
+			connectedAt := time.Now()
+
+			// closes the websocket connection when 'dispatch' returns
+			connCtx, disconnect := context.WithCancel(ctx)
+			replies.connected(chatServer)
+			if err := dispatch(connCtx, chatServer, mailServer, liveFwdConfig); err != nil {
 				logger.Error(err.Error())
 			}
+			replies.connected(nil)
+			disconnect()
+
+			for name, stats := range chatServer.CacheStats() {
+				logger.Infof("%s cache - hits: %d, misses: %d", name, stats.Hits, stats.Misses)
+			}
+
+			if time.Since(connectedAt) >= stableConnectionDuration {
+				retry.reset()
+			}
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if retry.exhausted(*reconnectMaxAttempts, *reconnectMaxDowntime) {
+			logger.Errorf("unable to connect to the chat-server after %d attempts - i give up", retry.attempts)
+			os.Exit(1)
 		}
+
+		delay := retry.next()
+		logger.Infof("reconnect in %s - attempt: %d", delay, retry.attempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	mailServer.Close()
+	logger.Info("shutdown complete")
+}
+
+// connect to the chat-server - per access token if it's set,
+// per login with user / password otherwise
+func connect(url *url.URL) (*chat.Mattermost, error) {
+	if len(*mattermostToken) > 0 {
+		return chat.ConnectWithToken(url, *mattermostToken)
 	}
+	return chat.Connect(url, *mattermostUser, *mattermostPass)
+}
+
+// readTokenFile reads the access token from the given file - surrounding
+// whitespace (like the trailing newline) is removed
+func readTokenFile(file string) (string, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read token file: %s", err.Error())
+	}
+
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return "", fmt.Errorf("empty token file: %s", file)
+	}
+	return token, nil
+}
+
+// newMailServer returns the mail-system for the '-mail-transport' url - smtp
+// per '-mail-host' if it's empty
+func newMailServer(auth mail.Auth, tlsSettings *mail.TLS) (mail.Server, error) {
+	if len(*mailTransport) == 0 {
+		return mail.New(*mailHost, auth, tlsSettings, *mailPoolSize, *mailPoolIdle), nil
+	}
+
+	u, err := url.Parse(*mailTransport)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "smtp":
+		host := *mailHost
+		if len(u.Host) > 0 {
+			host = u.Host
+		}
+		return mail.New(host, auth, tlsSettings, *mailPoolSize, *mailPoolIdle), nil
+	case "sendmail":
+		path := "/usr/sbin/sendmail"
+		if len(u.Path) > 0 {
+			path = u.Path
+		}
+		return mail.NewSendmail(path), nil
+	case "lmtp":
+		if len(u.Host) > 0 {
+			return mail.NewLMTP("tcp", u.Host), nil
+		}
+		if len(u.Path) > 0 {
+			return mail.NewLMTP("unix", u.Path), nil
+		}
+		return nil, fmt.Errorf("lmtp transport without address: '%s'", *mailTransport)
+	case "maildir":
+		if len(u.Path) == 0 {
+			return nil, fmt.Errorf("maildir transport without path: '%s'", *mailTransport)
+		}
+		return mail.NewMaildir(u.Path)
+	case "mbox":
+		if len(u.Path) == 0 {
+			return nil, fmt.Errorf("mbox transport without path: '%s'", *mailTransport)
+		}
+		return mail.NewMbox(u.Path)
+	}
+	return nil, fmt.Errorf("unknown transport: '%s' - expected one of: smtp, sendmail, lmtp, maildir or mbox", u.Scheme)
+}
+
+// mailAuthSettings returns the smtp authentication - the access token for 'xoauth2'
+// is refreshed per token endpoint if it's set, or read from the token file
+func mailAuthSettings() mail.Auth {
+	auth := mail.Auth{Mechanism: *mailAuth, User: *mailUser, Pass: *mailPass}
+	if len(*mailOAuthTokenURL) > 0 {
+		auth.Token = mail.TokenEndpoint(*mailOAuthTokenURL, *mailOAuthClientID, *mailOAuthClientSecret, *mailOAuthRefreshToken)
+	} else if len(*mailOAuthTokenFile) > 0 {
+		auth.Token = mail.TokenFile(*mailOAuthTokenFile)
+	}
+	return auth
+}
+
+// shutdownOnSignal returns a context which is canceled on SIGTERM or SIGINT.
+//
+// the 'sendCtx' for mail sends is canceled after the 'shutdown-timeout'.
+func shutdownOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var cancelSend context.CancelFunc
+	sendCtx, cancelSend = context.WithCancel(context.Background())
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigC
+		logger.Infof("signal: %s received - shutdown (timeout: %s)", sig, *shutdownTimeout)
+		cancel()
+		time.AfterFunc(*shutdownTimeout, func() {
+			logger.Error("shutdown timeout reached - abort mail sends in progress")
+			cancelSend()
+		})
+	}()
+	return ctx
+}
+
+// forwardConfig contains the forward mappings and the mail templates.
+//
+// it's immutable - a reload swaps the whole config (see 'liveConfig').
+type forwardConfig struct {
+	fwdMappings     []fwdMapping
+	subjectTemplate *template.Template
+	bodyTemplate    *template.Template
+
+	// template for html mails - html mails are disabled if 'nil'
+	htmlTemplate *htmltemplate.Template
+
+	// teams and channels where messages are forwarded - all if 'nil'
+	scope *scope
+
+	// where markers are accepted - see 'markerModePrefix' and 'markerModeAnywhere'
+	markerMode string
+}
+
+// newForwardConfig builds the forward config from the flags and the given
+// config file - the config file can be 'nil'. the config file is applied onto
+// the flag values from before the first apply - see 'flagDefaults'
+func newForwardConfig(cfg *config) (*forwardConfig, error) {
+	subject, body := flagDefault("mail-subject"), flagDefault("mail-body")
+	forwardFlag, mode := flagDefault("forward"), flagDefault("marker-mode")
+	html, htmlBody := flagDefault("mail-html"), flagDefault("mail-html-template")
+	teams, notTeams := flagDefault("allow-teams"), flagDefault("deny-teams")
+	channels, notChannels := flagDefault("allow-channels"), flagDefault("deny-channels")
+
+	var rules []fwdMapping
+	if cfg != nil {
+		subject = cfg.setting("mail-subject", subject)
+		body = cfg.setting("mail-body", body)
+		forwardFlag = cfg.setting("forward", forwardFlag)
+		teams = cfg.setting("allow-teams", teams)
+		notTeams = cfg.setting("deny-teams", notTeams)
+		channels = cfg.setting("allow-channels", channels)
+		notChannels = cfg.setting("deny-channels", notChannels)
+		mode = cfg.setting("marker-mode", mode)
+		html = cfg.setting("mail-html", html)
+		htmlBody = cfg.setting("mail-html-template", htmlBody)
+		rules = cfg.rules()
+	}
+
+	if err := validateMarkerMode(mode); err != nil {
+		return nil, err
+	}
+
+	var err error
+	fc := &forwardConfig{markerMode: mode}
+	if fc.scope, err = newScope(splitList(teams), splitList(notTeams), splitList(channels), splitList(notChannels)); err != nil {
+		return nil, err
+	}
+	if fc.subjectTemplate, err = template.New("mail-subject").Parse(subject); err != nil {
+		return nil, fmt.Errorf("invalid template for mail-subject - error: %s", err.Error())
+	}
+	if fc.bodyTemplate, err = template.New("mail-body").Parse(body); err != nil {
+		return nil, fmt.Errorf("invalid template for mail-body - error: %s", err.Error())
+	}
+	useHTML, err := strconv.ParseBool(html)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for mail-html: '%s' - expects 'true' or 'false'", html)
+	}
+	if useHTML {
+		if fc.htmlTemplate, err = htmltemplate.New("mail-html-template").Parse(htmlBody); err != nil {
+			return nil, fmt.Errorf("invalid template for mail-html-template - error: %s", err.Error())
+		}
+	}
+
+	if rules != nil {
+		fc.fwdMappings = rules
+	} else if fc.fwdMappings, err = parseFwdMappings(forwardFlag); err != nil {
+		return nil, err
+	}
+	return fc, nil
 }
 
 // fwdMapping contains a pair of a marker and a corresponding mail-address.
+//
+// forward rules from the config file can match the content with other
+// matchers (see 'matcher') - then the marker is empty.
 type fwdMapping struct {
 	marker   string
 	mailAddr string
+
+	// header of the recipient - the recipients of a rule gets one mail
+	rcpt rcptKind
+
+	// optional settings from a forward rule in the config file - can be 'nil'
+	opts *fwdOptions
+}
+
+// rcptKind is the header of a recipient: 'To', 'Cc' or 'Bcc'
+type rcptKind int
+
+// recipient kinds
+const (
+	rcptTo rcptKind = iota
+	rcptCc
+	rcptBcc
+)
+
+func (k rcptKind) String() string {
+	return [...]string{"to", "cc", "bcc"}[k]
+}
+
+// fwdOptions contains the optional settings from a forward rule.
+// the settings are shared for all mail-addresses of the rule.
+type fwdOptions struct {
+	// display name of the recipient
+	name string
+
+	// matches the content - per marker if 'nil'
+	matcher matcher
+
+	// templates for the mail - the global templates are used if 'nil'.
+	// a html template enables html mails for the rule.
+	subject *template.Template
+	body    *template.Template
+	html    *htmltemplate.Template
+
+	// teams and channels where the rule is allowed - all if 'nil'
+	scope *scope
+
+	// who can forward messages with the rule - everybody if 'nil'
+	permission *permission
+
+	// don't forward edited messages as corrections / deleted messages as retractions
+	noCorrections bool
+	noRetractions bool
 }
 
 func parseFwdMappings(s string) ([]fwdMapping, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, errors.New("flag 'forward' are mandatory")
+	}
+
 	fwdMappings := []fwdMapping{}
 	for _, mapping := range strings.Split(s, ",") {
 		x := strings.Split(mapping, "=")
 		if len(x) != 2 {
-			msg := "invalid format: '%s' - valid example: 'user=abc@mail.com'"
+			msg := "invalid format in flag 'forward': '%s' - valid example: 'user=abc@mail.com'"
 			return nil, fmt.Errorf(msg, mapping)
 		}
 		marker := strings.TrimSpace(x[0])
 		mailAddr := strings.TrimSpace(x[1])
 		logger.Debugf("forward messages with marker: '@%s' to %s", marker, mailAddr)
-		fwdMappings = append(fwdMappings, fwdMapping{marker, mailAddr})
+		fwdMappings = append(fwdMappings, fwdMapping{marker: marker, mailAddr: mailAddr})
 	}
 	return fwdMappings, nil
 }
@@ -2,11 +2,15 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/section77/matterbot/logger"
+	"github.com/section77/matterbot/mail"
 )
 
 // TestMain is the driver for the unit tests
@@ -41,14 +45,14 @@ func TestParseFwdMappings(t *testing.T) {
 
 	// pair of valid values
 	validateParseFwdMappings([]fwdMapping{
-		fwdMapping{"user1", "user1@mail.com"},
-		fwdMapping{"user2", "abc@gmail.com"}},
+		fwdMapping{marker: "user1", mailAddr: "user1@mail.com"},
+		fwdMapping{marker: "user2", mailAddr: "abc@gmail.com"}},
 		"user1=user1@mail.com,user2=abc@gmail.com", t)
 
 	// pair with valid values and spaces
 	validateParseFwdMappings([]fwdMapping{
-		fwdMapping{"user1", "user1@mail.com"},
-		fwdMapping{"user2", "abc@gmail.com"}},
+		fwdMapping{marker: "user1", mailAddr: "user1@mail.com"},
+		fwdMapping{marker: "user2", mailAddr: "abc@gmail.com"}},
 		" user1 = user1@mail.com , user2 = abc@gmail.com", t)
 
 	// empty: invalid
@@ -87,3 +91,77 @@ func validateParseFwdMappingsErr(name, s, expected string, t *testing.T) {
 		t.Errorf("%s: expected error not found - found: \"%s\", expected: \"%s\"", name, err.Error(), expected)
 	}
 }
+
+// the mail transport should be selected per url
+func TestNewMailServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { *mailTransport = "" }()
+
+	tests := []struct {
+		transport string
+		expected  string
+	}{
+		{"", ""},
+		{"smtp://mail.example.com:587", ""},
+		{"sendmail:", ""},
+		{"sendmail:///usr/lib/sendmail", ""},
+		{"lmtp:///run/lmtp.sock", ""},
+		{"lmtp://localhost:24", ""},
+		{"maildir://" + filepath.Join(dir, "Maildir"), ""},
+		{"mbox://" + filepath.Join(dir, "archive.mbox"), ""},
+		{"lmtp:", "lmtp transport without address: 'lmtp:'"},
+		{"maildir:", "maildir transport without path: 'maildir:'"},
+		{"mbox:", "mbox transport without path: 'mbox:'"},
+		{"pigeon://roof", "unknown transport: 'pigeon' - expected one of: smtp, sendmail, lmtp, maildir or mbox"},
+	}
+
+	for _, test := range tests {
+		*mailTransport = test.transport
+		server, err := newMailServer(mail.Auth{}, nil)
+		if test.expected == "" {
+			if err != nil || server == nil {
+				t.Errorf("transport: '%s' - unexpected error: %v", test.transport, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("transport: '%s' - expected error: '%s', found: %v", test.transport, test.expected, err)
+		}
+	}
+}
+
+// the token should be read without the surrounding whitespace - a missing
+// or empty file should fail
+func TestReadTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("  secret-token\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if token, err := readTokenFile(tokenFile); err != nil || token != "secret-token" {
+		t.Errorf("expected the token: 'secret-token', found: '%s' - error: %v", token, err)
+	}
+
+	missingFile := filepath.Join(dir, "missing")
+	if _, err := readTokenFile(missingFile); err == nil || !strings.HasPrefix(err.Error(), "unable to read token file: ") || !strings.Contains(err.Error(), missingFile) {
+		t.Errorf("expected an error with the missing file: %s - found: %v", missingFile, err)
+	}
+
+	if _, err := readTokenFile(emptyFile); err == nil || err.Error() != "empty token file: "+emptyFile {
+		t.Errorf("expected an error for the empty file - found: %v", err)
+	}
+}
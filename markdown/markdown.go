@@ -0,0 +1,192 @@
+// Package markdown renders the markdown of chat messages as html or as plain text
+package markdown
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// mattermost supports the github flavored markdown - with tables, strikethrough,
+// autolinks and task lists
+var md = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// the html is sanitized - it's from user generated content
+var policy = bluemonday.UGCPolicy()
+
+// ToHTML renders the markdown as sanitized html
+func ToHTML(src string) string {
+	var buf bytes.Buffer
+	if err := md.Convert([]byte(src), &buf); err != nil {
+		logger.Errorf("unable to render markdown - send it escaped - error: %s", err.Error())
+		return "<pre>" + policy.Sanitize(src) + "</pre>"
+	}
+	return policy.Sanitize(buf.String())
+}
+
+// ToText renders the markdown as readable plain text:
+//
+//   - the markup for emphasis, headings and code is removed
+//   - links are written as: 'text (url)'
+//   - list items are written with '- ' or '1. '
+//   - table cells are separated with ' | '
+//   - raw html is removed
+func ToText(src string) string {
+	source := []byte(src)
+	doc := md.Parser().Parse(text.NewReader(source))
+
+	w := &textWriter{source: source}
+	ast.Walk(doc, w.walk)
+	return strings.TrimSpace(w.buf.String())
+}
+
+type textWriter struct {
+	source []byte
+	buf    bytes.Buffer
+}
+
+func (w *textWriter) walk(n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering && n.Type() == ast.TypeBlock && n.PreviousSibling() != nil && !isTablePart(n) {
+		if _, ok := n.(*ast.ListItem); ok || isTightListItem(n.Parent()) {
+			w.newlines(1)
+		} else {
+			w.newlines(2)
+		}
+	}
+
+	switch n := n.(type) {
+	case *ast.Text:
+		if entering {
+			w.buf.Write(n.Segment.Value(w.source))
+			if n.HardLineBreak() || n.SoftLineBreak() {
+				w.buf.WriteString("\n")
+			}
+		}
+	case *ast.String:
+		if entering {
+			w.buf.Write(n.Value)
+		}
+	case *ast.FencedCodeBlock, *ast.CodeBlock:
+		if entering {
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				line := lines.At(i)
+				w.buf.Write(line.Value(w.source))
+			}
+		}
+		return ast.WalkSkipChildren, nil
+	case *ast.RawHTML, *ast.HTMLBlock:
+		return ast.WalkSkipChildren, nil
+	case *ast.AutoLink:
+		if entering {
+			w.buf.Write(n.URL(w.source))
+		}
+		return ast.WalkSkipChildren, nil
+	case *ast.Link:
+		if !entering && string(n.Destination) != textOf(n, w.source) {
+			fmt.Fprintf(&w.buf, " (%s)", n.Destination)
+		}
+	case *ast.Image:
+		if !entering {
+			fmt.Fprintf(&w.buf, " (%s)", n.Destination)
+		}
+	case *ast.ListItem:
+		if entering {
+			w.listMarker(n)
+		}
+	case *ast.ThematicBreak:
+		if entering {
+			w.buf.WriteString("----")
+		}
+	case *extast.TaskCheckBox:
+		if entering && n.IsChecked {
+			w.buf.WriteString("[x] ")
+		} else if entering {
+			w.buf.WriteString("[ ] ")
+		}
+	case *extast.TableRow, *extast.TableHeader:
+		if entering && n.PreviousSibling() != nil {
+			w.newlines(1)
+		}
+	case *extast.TableCell:
+		if entering && n.PreviousSibling() != nil {
+			w.buf.WriteString(" | ")
+		}
+	}
+	return ast.WalkContinue, nil
+}
+
+// listMarker writes the indentation and the marker of the list item
+func (w *textWriter) listMarker(item *ast.ListItem) {
+	list := item.Parent().(*ast.List)
+
+	depth := 0
+	for p := list.Parent(); p != nil; p = p.Parent() {
+		if _, ok := p.(*ast.List); ok {
+			depth++
+		}
+	}
+	w.buf.WriteString(strings.Repeat("  ", depth))
+
+	if !list.IsOrdered() {
+		w.buf.WriteString("- ")
+		return
+	}
+
+	nr := list.Start
+	for p := item.PreviousSibling(); p != nil; p = p.PreviousSibling() {
+		nr++
+	}
+	fmt.Fprintf(&w.buf, "%d. ", nr)
+}
+
+// newlines ensures that the text ends with the given number of newlines
+func (w *textWriter) newlines(n int) {
+	if w.buf.Len() == 0 {
+		return
+	}
+
+	b := w.buf.Bytes()
+	for i := len(b) - 1; i >= 0 && b[i] == '\n' && n > 0; i-- {
+		n--
+	}
+	w.buf.WriteString(strings.Repeat("\n", n))
+}
+
+// isTablePart returns 'true' for table rows and cells - they are separated per table
+func isTablePart(n ast.Node) bool {
+	switch n.(type) {
+	case *extast.TableRow, *extast.TableHeader, *extast.TableCell:
+		return true
+	}
+	return false
+}
+
+// isTightListItem returns 'true' if the node is an item of a list without blank lines between the items
+func isTightListItem(n ast.Node) bool {
+	if _, ok := n.(*ast.ListItem); !ok {
+		return false
+	}
+	list, ok := n.Parent().(*ast.List)
+	return ok && list.IsTight
+}
+
+// textOf returns the text of the node's children
+func textOf(n ast.Node, source []byte) string {
+	var buf bytes.Buffer
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if t, ok := c.(*ast.Text); ok {
+			buf.Write(t.Segment.Value(source))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,55 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		markdown string
+		expected string
+	}{
+		{"**bold** and _em_", "<p><strong>bold</strong> and <em>em</em></p>"},
+		{"[link](https://example.com)", `<p><a href="https://example.com" rel="nofollow">link</a></p>`},
+		{"| a | b |\n|---|---|\n| 1 | 2 |", "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>1</td>\n<td>2</td>\n</tr>\n</tbody>\n</table>"},
+
+		// sanitized
+		{"[x](javascript:alert(1))", "<p>x</p>"},
+		{"<script>alert(1)</script>text", ""},
+		{"<b onclick=\"alert(1)\">x</b>", "<p>x</p>"},
+		{"![img](https://example.com/x.png \"title\")", `<p><img src="https://example.com/x.png" alt="img" title="title"></p>`},
+	}
+
+	for _, test := range tests {
+		if html := strings.TrimSpace(ToHTML(test.markdown)); html != test.expected {
+			t.Errorf("markdown: %q\n\texpected: %q\n\tfound:    %q", test.markdown, test.expected, html)
+		}
+	}
+}
+
+func TestToText(t *testing.T) {
+	tests := []struct {
+		markdown string
+		expected string
+	}{
+		{"**bold** and _em_ and ~~strike~~", "bold and em and strike"},
+		{"# Heading\n\nparagraph\nwith soft break", "Heading\n\nparagraph\nwith soft break"},
+		{"see [the docs](https://example.com) or https://example.org", "see the docs (https://example.com) or https://example.org"},
+		{"[https://example.com](https://example.com)", "https://example.com"},
+		{"use `code`", "use code"},
+		{"```go\nfunc main() {\n}\n```\nafter", "func main() {\n}\n\nafter"},
+		{"- a\n- b\n  - c\n\n1. x\n2. y", "- a\n- b\n  - c\n\n1. x\n2. y"},
+		{"- [x] done\n- [ ] open", "- [x] done\n- [ ] open"},
+		{"| a | b |\n|---|---|\n| 1 | 2 |", "a | b\n1 | 2"},
+		{"text <b>html</b>", "text html"},
+		{"> quote", "quote"},
+		{"a\n\n---\n\nb", "a\n\n----\n\nb"},
+	}
+
+	for _, test := range tests {
+		if text := ToText(test.markdown); text != test.expected {
+			t.Errorf("markdown: %q\n\texpected: %q\n\tfound:    %q", test.markdown, test.expected, text)
+		}
+	}
+}
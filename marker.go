@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// marker modes - where markers are accepted in a message
+const (
+	// markers only at the start of the message (default)
+	markerModePrefix = "prefix"
+
+	// markers anywhere in the message as whole words
+	markerModeAnywhere = "anywhere"
+)
+
+// validateMarkerMode checks the given marker mode
+func validateMarkerMode(mode string) error {
+	if mode != markerModePrefix && mode != markerModeAnywhere {
+		return fmt.Errorf("invalid marker mode: '%s' - valid values: '%s', '%s'", mode, markerModePrefix, markerModeAnywhere)
+	}
+	return nil
+}
+
+// findFwdMappingsAnywhere finds the markers anywhere in the given content.
+//
+// a marker is found if:
+//   - it's a whole word: '@ml' matches in 'reminder for @ml: ...', but not
+//     in 'user@ml.com' or '@mlx'
+//   - it's not in a code block, in inline code or in an url
+//
+// the markers at the start of the content are removed together with the
+// following separators (space, ',' or ':'), the markers at the end together
+// with the preceding separators (space or ','). markers within the text
+// stays as written.
+//
+// returns all found forward-mappings and the content with the leading and
+// trailing markers removed
+func findFwdMappingsAnywhere(content string, allFwdMappings []fwdMapping) ([]fwdMapping, string, bool) {
+	markers := findMarkers(content, allFwdMappings)
+
+	foundFwdMappings := []fwdMapping{}
+	seen := map[string]bool{}
+	for _, marker := range markers {
+		if seen[marker.name] {
+			continue
+		}
+		seen[marker.name] = true
+
+		for _, m := range allFwdMappings {
+			if m.marker == marker.name {
+				foundFwdMappings = append(foundFwdMappings, m)
+			}
+		}
+	}
+
+	return foundFwdMappings, stripMarkers(content, markers), len(foundFwdMappings) > 0
+}
+
+// markerPos is the position of a marker in the content - 'end' is exclusive
+type markerPos struct {
+	name       string
+	start, end int
+}
+
+// findMarkers returns the positions of all configured markers outside of code and urls
+func findMarkers(content string, allFwdMappings []fwdMapping) []markerPos {
+	known := map[string]bool{}
+	for _, m := range allFwdMappings {
+		known[m.marker] = true
+	}
+
+	skip := append(codeSpans(content), urlSpans(content)...)
+
+	markers := []markerPos{}
+	for i := 0; i < len(content); i++ {
+		if content[i] != '@' {
+			continue
+		}
+		if s, ok := skip.find(i); ok {
+			i = s.end - 1
+			continue
+		}
+
+		// the marker must start a new word
+		if prev, _ := utf8.DecodeLastRuneInString(content[:i]); i > 0 && isWordBefore(prev) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(content) {
+			r, size := utf8.DecodeRuneInString(content[end:])
+			if !isMarkerRune(r) {
+				break
+			}
+			end += size
+		}
+
+		// a trailing dot ends the sentence - it's not part of the marker
+		for end > i+1 && content[end-1] == '.' {
+			end--
+		}
+
+		if name := content[i+1 : end]; known[name] {
+			markers = append(markers, markerPos{name, i, end})
+		}
+		i = end - 1
+	}
+	return markers
+}
+
+// stripMarkers removes the leading and the trailing markers from the content
+func stripMarkers(content string, markers []markerPos) string {
+	isSeparator := func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == ':'
+	}
+
+	isTrailingSeparator := func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	}
+
+	// a marker is only removed if it's a separate word - not in: '@ml's'
+	separatedAfter := func(m markerPos) bool {
+		r, _ := utf8.DecodeRuneInString(content[m.end:])
+		return m.end == len(content) || isSeparator(r)
+	}
+	separatedBefore := func(m markerPos) bool {
+		r, _ := utf8.DecodeLastRuneInString(content[:m.start])
+		return m.start == 0 || isTrailingSeparator(r)
+	}
+
+	start := len(content) - len(strings.TrimLeftFunc(content, isSeparator))
+	i := 0
+	for ; i < len(markers) && markers[i].start == start && separatedAfter(markers[i]); i++ {
+		start = len(content) - len(strings.TrimLeftFunc(content[markers[i].end:], isSeparator))
+	}
+
+	end := len(strings.TrimRightFunc(content, unicode.IsSpace))
+	for j := len(markers) - 1; j >= i && markers[j].end == end && markers[j].start >= start && separatedBefore(markers[j]); j-- {
+		end = len(strings.TrimRightFunc(content[:markers[j].start], isTrailingSeparator))
+	}
+
+	if end <= start {
+		return ""
+	}
+	return content[start:end]
+}
+
+// isWordBefore returns 'true' if the given rune, directly before a '@',
+// belongs to a word - like in a mail address
+func isWordBefore(r rune) bool {
+	return isMarkerRune(r) || r == '@' || r == '+'
+}
+
+// isMarkerRune returns 'true' for all runes which are valid in a marker
+func isMarkerRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// span is a range in the content - 'end' is exclusive
+type span struct {
+	start, end int
+}
+
+type spans []span
+
+// find returns the span which contains the given position
+func (ss spans) find(pos int) (span, bool) {
+	for _, s := range ss {
+		if pos >= s.start && pos < s.end {
+			return s, true
+		}
+	}
+	return span{}, false
+}
+
+// urls with a scheme, like 'https://...' or 'mailto:...'
+var urlRegexp = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://|mailto:)\S+`)
+
+func urlSpans(content string) spans {
+	ss := spans{}
+	for _, x := range urlRegexp.FindAllStringIndex(content, -1) {
+		ss = append(ss, span{x[0], x[1]})
+	}
+	return ss
+}
+
+// codeSpans returns the fenced code blocks and the inline code in the content
+func codeSpans(content string) spans {
+	ss := fencedCodeSpans(content)
+
+	backtickRun := func(i int) int {
+		n := 0
+		for i+n < len(content) && content[i+n] == '`' {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(content); {
+		if s, ok := ss.find(i); ok {
+			i = s.end
+			continue
+		}
+		if content[i] != '`' {
+			i++
+			continue
+		}
+
+		// inline code ends with a backtick run of the same length.
+		// without a closing run, the backticks are literal.
+		n := backtickRun(i)
+		closing := -1
+		for j := i + n; j < len(content); {
+			if _, ok := ss.find(j); ok {
+				break
+			}
+			if content[j] != '`' {
+				j++
+				continue
+			}
+			m := backtickRun(j)
+			if m == n {
+				closing = j + m
+				break
+			}
+			j += m
+		}
+
+		if closing < 0 {
+			i += n
+			continue
+		}
+		ss = append(ss, span{i, closing})
+		i = closing
+	}
+	return ss
+}
+
+// fencedCodeSpans returns the code blocks between '```' or '~~~' lines.
+// a code block without a closing fence ends at the end of the content.
+func fencedCodeSpans(content string) spans {
+	ss := spans{}
+
+	// fence returns the fence char and the length of the fence - 0 if the line isn't a fence
+	fence := func(line string) (byte, int) {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if len(line)-len(trimmed) > 3 || len(trimmed) < 3 || (trimmed[0] != '`' && trimmed[0] != '~') {
+			return 0, 0
+		}
+		n := len(trimmed) - len(strings.TrimLeft(trimmed, trimmed[:1]))
+		if n < 3 {
+			return 0, 0
+		}
+		return trimmed[0], n
+	}
+
+	var open byte
+	var openLen, start int
+	for pos := 0; pos < len(content); {
+		end := strings.IndexByte(content[pos:], '\n')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += pos + 1
+		}
+		line := content[pos:end]
+		c, n := fence(strings.TrimSuffix(line, "\n"))
+
+		switch {
+		case open == 0 && n > 0:
+			open, openLen, start = c, n, pos
+		case open != 0 && c == open && n >= openLen && strings.TrimSpace(strings.TrimLeft(line, " "+string(c))) == "":
+			ss = append(ss, span{start, end})
+			open = 0
+		}
+		pos = end
+	}
+
+	if open != 0 {
+		ss = append(ss, span{start, len(content)})
+	}
+	return ss
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/mail"
+)
+
+var markerTestMappings = []fwdMapping{
+	fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+	fwdMapping{marker: "board", mailAddr: "board@mail.com"},
+	fwdMapping{marker: "board", mailAddr: "archive@mail.com"},
+	fwdMapping{marker: "dev.ops", mailAddr: "ops@mail.com"},
+}
+
+func TestFindFwdMappingsAnywhere(t *testing.T) {
+	tests := []struct {
+		content         string
+		expectedMarkers []string
+		expectedContent string
+	}{
+		// leading markers - like in the 'prefix' mode
+		{"@ml test", []string{"ml"}, "test"},
+		{"  @ml, @board: test", []string{"ml", "board", "board"}, "test"},
+		{"@ml", []string{"ml"}, ""},
+
+		// markers within the text stays
+		{"Reminder for @ml: meeting at 4", []string{"ml"}, "Reminder for @ml: meeting at 4"},
+		{"(@ml) meeting", []string{"ml"}, "(@ml) meeting"},
+		{"ask @dev.ops.", []string{"dev.ops"}, "ask @dev.ops."},
+		{"@ml's meeting", []string{"ml"}, "@ml's meeting"},
+
+		// trailing markers
+		{"meeting at 4 @ml", []string{"ml"}, "meeting at 4"},
+		{"meeting at 4, @ml @board  ", []string{"ml", "board", "board"}, "meeting at 4"},
+		{"@ml meeting at 4 @board", []string{"ml", "board", "board"}, "meeting at 4"},
+
+		// each marker only once
+		{"@ml meeting with @ml", []string{"ml"}, "meeting with"},
+
+		// only whole words
+		{"mail to user@ml.com", nil, ""},
+		{"mail to user@ml", nil, ""},
+		{"@mlx @ml_ @ml-x test", nil, ""},
+		{"@@ml test", nil, ""},
+
+		// not in code or urls
+		{"use `@ml` to forward", nil, ""},
+		{"use ``a ` @ml`` to forward", nil, ""},
+		{"```\n@ml\n```\ntext", nil, ""},
+		{"~~~ go\n@ml\n~~~", nil, ""},
+		{"```\nunclosed @ml", nil, ""},
+		{"see https://example.com/@ml and mailto:@ml", nil, ""},
+		{"see [link](https://example.com/@ml)", nil, ""},
+
+		// but outside of code and urls
+		{"unclosed ` @ml", []string{"ml"}, "unclosed `"},
+		{"`code` @ml", []string{"ml"}, "`code`"},
+		{"```\ncode\n```\n@ml done", []string{"ml"}, "```\ncode\n```\n@ml done"},
+		{"https://example.com @ml", []string{"ml"}, "https://example.com"},
+	}
+
+	for _, test := range tests {
+		mappings, content, found := findFwdMappingsAnywhere(test.content, markerTestMappings)
+
+		if found != (len(test.expectedMarkers) > 0) {
+			t.Errorf("content: %q - unexpected found: %t", test.content, found)
+			continue
+		}
+
+		markers := []string{}
+		for _, m := range mappings {
+			markers = append(markers, m.marker)
+		}
+		if strings.Join(markers, ",") != strings.Join(test.expectedMarkers, ",") {
+			t.Errorf("content: %q - expected markers: %v, found: %v", test.content, test.expectedMarkers, markers)
+		}
+
+		if found && content != test.expectedContent {
+			t.Errorf("content: %q - expected stripped content: %q, found: %q", test.content, test.expectedContent, content)
+		}
+	}
+}
+
+func TestValidateMarkerMode(t *testing.T) {
+	for _, mode := range []string{markerModePrefix, markerModeAnywhere} {
+		if err := validateMarkerMode(mode); err != nil {
+			t.Errorf("unexpected error for mode: '%s' - %s", mode, err.Error())
+		}
+	}
+
+	if err := validateMarkerMode("everywhere"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+}
+
+// with the 'anywhere' mode, markers within the message should be forwarded
+func TestDispatchWithMarkerModeAnywhere(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	lc := testConfig(fwdMapping{marker: "ml", mailAddr: "ml@mail.com"})
+	fc := *lc.load()
+	fc.markerMode = markerModeAnywhere
+	lc.store(&fc)
+
+	go dispatch(context.Background(), chatMock, mailMock, lc)
+
+	chatMock.TriggerMsgEvent(chat.Message{UserName: "user", ChannelName: "channel", Content: "Reminder for @ml: meeting at 4"})
+	chatMock.TriggerMsgEvent(chat.Message{UserName: "user", ChannelName: "channel", Content: "use `@ml` to forward"})
+
+	if len(mailMock.Messages()) != 1 {
+		t.Fatalf("expected one mail message - found: %d", len(mailMock.Messages()))
+	}
+	if mailMock.Messages()[0].Content != "Reminder for @ml: meeting at 4" {
+		t.Errorf("unexpected content: %q", mailMock.Messages()[0].Content)
+	}
+}
+
+func FuzzFindFwdMappings(f *testing.F) {
+	for _, seed := range []string{
+		"@ml test",
+		"@ml, @board: test @ml",
+		"Reminder for @ml: meeting at 4",
+		"use `@ml` or ``@board`` in ```\n@ml\n```",
+		"see https://example.com/@ml",
+		"user@ml.com @dev.ops.",
+		"@",
+		"`",
+		"```",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, content string) {
+		for mode, find := range map[string]func(string, []fwdMapping) ([]fwdMapping, string, bool){
+			markerModePrefix:   findFwdMappings,
+			markerModeAnywhere: findFwdMappingsAnywhere,
+		} {
+			mappings, stripped, found := find(content, markerTestMappings)
+
+			if found != (len(mappings) > 0) {
+				t.Errorf("%s: found: %t, but %d mappings", mode, found, len(mappings))
+			}
+
+			// only the markers are removed - never any other content
+			if !strings.Contains(content, stripped) {
+				t.Errorf("%s: stripped content: %q isn't a part of: %q", mode, stripped, content)
+			}
+
+			for _, m := range mappings {
+				if !strings.Contains(content, "@"+m.marker) {
+					t.Errorf("%s: marker: '%s' not in: %q", mode, m.marker, content)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// matcher checks if the content of a message matches a forward rule.
+//
+// the matchers are:
+//   - markerMatcher: '@marker' - per 'findFwdMappings' or 'findFwdMappingsAnywhere'
+//   - hashtagMatcher: '#hashtag' as a whole word
+//   - regexMatcher: any regular expression
+//   - allMatcher / anyMatcher: combinations of other matchers
+type matcher interface {
+	// match returns 'true' if the content matches - and the content without
+	// the matched text, if the matcher strips it
+	match(content string, env *matchEnv) (bool, string)
+
+	// walk calls the given function for this matcher and all nested matchers
+	walk(func(matcher))
+
+	String() string
+}
+
+// matchEnv contains the settings from the forward config for the matchers
+type matchEnv struct {
+	// 'findFwdMappings' or 'findFwdMappingsAnywhere' - per marker mode
+	findMarkers func(string, []fwdMapping) ([]fwdMapping, string, bool)
+
+	// all markers in the forward config - adjacent markers are stripped together
+	markers []fwdMapping
+}
+
+// fwdMatch is a forward mapping which matches a message
+type fwdMatch struct {
+	fwdMapping
+
+	// the content to forward - without the stripped text
+	content string
+}
+
+// match returns all forward mappings which matches the given content
+func (fc *forwardConfig) match(content string) []fwdMatch {
+	env := &matchEnv{findMarkers: findFwdMappings}
+	if fc.markerMode == markerModeAnywhere {
+		env.findMarkers = findFwdMappingsAnywhere
+	}
+	for _, m := range fc.fwdMappings {
+		m.matcher().walk(func(x matcher) {
+			if mm, ok := x.(*markerMatcher); ok {
+				env.markers = append(env.markers, fwdMapping{marker: mm.marker})
+			}
+		})
+	}
+
+	matches := []fwdMatch{}
+	for _, m := range fc.fwdMappings {
+		if ok, stripped := m.matcher().match(content, env); ok {
+			matches = append(matches, fwdMatch{m, stripped})
+		}
+	}
+	return matches
+}
+
+// matcher returns the matcher of the mapping - mappings without
+// a matcher (like from the 'forward' flag) matches per marker
+func (m fwdMapping) matcher() matcher {
+	if m.opts != nil && m.opts.matcher != nil {
+		return m.opts.matcher
+	}
+	return &markerMatcher{marker: m.marker, strip: true}
+}
+
+// label describes the mapping in logs and replies - like '@ml' or '#incident'
+func (m fwdMapping) label() string {
+	return m.matcher().String()
+}
+
+// markerMatcher matches a '@marker'
+type markerMatcher struct {
+	marker string
+	strip  bool
+}
+
+func (m *markerMatcher) match(content string, env *matchEnv) (bool, string) {
+	found, stripped, ok := env.findMarkers(content, env.markers)
+	if !ok {
+		return false, content
+	}
+
+	for _, f := range found {
+		if f.marker == m.marker {
+			if m.strip {
+				return true, stripped
+			}
+			return true, content
+		}
+	}
+	return false, content
+}
+
+func (m *markerMatcher) walk(f func(matcher)) { f(m) }
+func (m *markerMatcher) String() string       { return "@" + m.marker }
+
+// hashtagMatcher matches a '#hashtag' as a whole word (case-insensitive) - but
+// not in code blocks, in inline code or in urls
+type hashtagMatcher struct {
+	hashtag string
+	strip   bool
+}
+
+func (m *hashtagMatcher) match(content string, env *matchEnv) (bool, string) {
+	skip := append(codeSpans(content), urlSpans(content)...)
+
+	found := spans{}
+	for i := 0; i < len(content); i++ {
+		if content[i] != '#' {
+			continue
+		}
+		if s, ok := skip.find(i); ok {
+			i = s.end - 1
+			continue
+		}
+		if prev, _ := utf8.DecodeLastRuneInString(content[:i]); i > 0 && (isWordBefore(prev) || prev == '#' || prev == '&') {
+			continue
+		}
+
+		end := i + 1
+		for end < len(content) {
+			r, size := utf8.DecodeRuneInString(content[end:])
+			if !isMarkerRune(r) {
+				break
+			}
+			end += size
+		}
+		for end > i+1 && content[end-1] == '.' {
+			end--
+		}
+
+		if strings.EqualFold(content[i+1:end], m.hashtag) {
+			found = append(found, span{i, end})
+		}
+		i = end - 1
+	}
+
+	if len(found) == 0 {
+		return false, content
+	}
+	if m.strip {
+		return true, removeSpans(content, found)
+	}
+	return true, content
+}
+
+func (m *hashtagMatcher) walk(f func(matcher)) { f(m) }
+func (m *hashtagMatcher) String() string       { return "#" + m.hashtag }
+
+// regexMatcher matches a regular expression - like '(?i)outage'
+type regexMatcher struct {
+	re    *regexp.Regexp
+	strip bool
+}
+
+func (m *regexMatcher) match(content string, env *matchEnv) (bool, string) {
+	found := spans{}
+	for _, x := range m.re.FindAllStringIndex(content, -1) {
+		found = append(found, span{x[0], x[1]})
+	}
+
+	if len(found) == 0 {
+		return false, content
+	}
+	if m.strip {
+		return true, removeSpans(content, found)
+	}
+	return true, content
+}
+
+func (m *regexMatcher) walk(f func(matcher)) { f(m) }
+func (m *regexMatcher) String() string       { return "/" + m.re.String() + "/" }
+
+// allMatcher matches if all nested matchers matches
+type allMatcher []matcher
+
+func (ms allMatcher) match(content string, env *matchEnv) (bool, string) {
+	for _, m := range ms {
+		var ok bool
+		if ok, content = m.match(content, env); !ok {
+			return false, content
+		}
+	}
+	return true, content
+}
+
+func (ms allMatcher) walk(f func(matcher)) { walkAll(ms, f) }
+func (ms allMatcher) String() string       { return "all(" + joinMatchers(ms) + ")" }
+
+// anyMatcher matches if any of the nested matchers matches
+type anyMatcher []matcher
+
+func (ms anyMatcher) match(content string, env *matchEnv) (bool, string) {
+	found := false
+	for _, m := range ms {
+		if ok, stripped := m.match(content, env); ok {
+			found, content = true, stripped
+		}
+	}
+	return found, content
+}
+
+func (ms anyMatcher) walk(f func(matcher)) { walkAll(ms, f) }
+func (ms anyMatcher) String() string       { return "any(" + joinMatchers(ms) + ")" }
+
+func walkAll(ms []matcher, f func(matcher)) {
+	for _, m := range ms {
+		m.walk(f)
+	}
+}
+
+func joinMatchers(ms []matcher) string {
+	xs := []string{}
+	for _, m := range ms {
+		xs = append(xs, m.String())
+	}
+	return strings.Join(xs, ", ")
+}
+
+// setStrip sets, if the matched text is stripped, for the given matcher and
+// all nested matchers
+func setStrip(m matcher, strip bool) {
+	m.walk(func(x matcher) {
+		switch x := x.(type) {
+		case *markerMatcher:
+			x.strip = strip
+		case *hashtagMatcher:
+			x.strip = strip
+		case *regexMatcher:
+			x.strip = strip
+		}
+	})
+}
+
+// newRegexMatcher compiles the given regular expression
+func newRegexMatcher(expr string) (*regexMatcher, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: '%s' - %s", expr, err.Error())
+	}
+	return &regexMatcher{re: re}, nil
+}
+
+// removeSpans removes the given (sorted, not overlapping) spans from the content.
+// the surrounding spaces are trimmed.
+func removeSpans(content string, ss spans) string {
+	var b strings.Builder
+	last := 0
+	for _, s := range ss {
+		b.WriteString(content[last:s.start])
+		last = s.end
+	}
+	b.WriteString(content[last:])
+	return strings.TrimSpace(b.String())
+}
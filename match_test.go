@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/mail"
+)
+
+func TestMatchers(t *testing.T) {
+	incident := &hashtagMatcher{hashtag: "incident"}
+	outage, _ := newRegexMatcher("(?i)outage")
+	outageStrip, _ := newRegexMatcher("(?i)outage")
+	outageStrip.strip = true
+
+	fc := &forwardConfig{fwdMappings: []fwdMapping{
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+		fwdMapping{mailAddr: "incident@mail.com", opts: &fwdOptions{matcher: incident}},
+		fwdMapping{mailAddr: "outage@mail.com", opts: &fwdOptions{matcher: outage}},
+		fwdMapping{mailAddr: "strip@mail.com", opts: &fwdOptions{matcher: outageStrip}},
+		fwdMapping{mailAddr: "all@mail.com", opts: &fwdOptions{matcher: allMatcher{&markerMatcher{marker: "board", strip: true}, incident}}},
+		fwdMapping{mailAddr: "any@mail.com", opts: &fwdOptions{matcher: anyMatcher{&markerMatcher{marker: "board"}, outage}}},
+	}}
+
+	tests := []struct {
+		content  string
+		expected []string
+	}{
+		{"@ml test", []string{"ml@mail.com:test"}},
+		{"db down #incident", []string{"incident@mail.com:db down #incident"}},
+		{"db down #Incident.", []string{"incident@mail.com:db down #Incident."}},
+		{"Outage in the db", []string{"outage@mail.com:Outage in the db", "strip@mail.com:in the db", "any@mail.com:Outage in the db"}},
+		{"@board #incident db down", []string{
+			"incident@mail.com:@board #incident db down",
+			"all@mail.com:#incident db down",
+			"any@mail.com:@board #incident db down",
+		}},
+		{"@ml @board test", []string{"ml@mail.com:test", "any@mail.com:@ml @board test"}},
+
+		// no matches
+		{"test @ml", nil},
+		{"#incidents and `#incident` and https://example.com/#incident", nil},
+		{"x#incident", nil},
+	}
+
+	for _, test := range tests {
+		found := []string{}
+		for _, m := range fc.match(test.content) {
+			found = append(found, m.mailAddr+":"+m.content)
+		}
+
+		if strings.Join(found, "|") != strings.Join(test.expected, "|") {
+			t.Errorf("content: %q\n\texpected: %q\n\tfound: %q", test.content, test.expected, found)
+		}
+	}
+}
+
+func TestMatcherLabels(t *testing.T) {
+	outage, _ := newRegexMatcher("(?i)outage")
+	m := fwdMapping{opts: &fwdOptions{matcher: anyMatcher{&hashtagMatcher{hashtag: "incident"}, outage}}}
+	if m.label() != "any(#incident, /(?i)outage/)" {
+		t.Errorf("unexpected label: %s", m.label())
+	}
+
+	if m := (fwdMapping{marker: "ml"}); m.label() != "@ml" {
+		t.Errorf("unexpected label: %s", m.label())
+	}
+}
+
+func TestParseConfigMatchers(t *testing.T) {
+	cfg, err := parseConfig("test.yml", []byte(`
+forward:
+  - marker: ml
+    to: ml@example.com
+  - any: [{hashtag: incident}, {regex: '(?i)outage'}]
+    to: oncall@example.com
+  - marker: board
+    hashtag: [vote, poll]
+    to: board@example.com
+  - regex: '(?i)outage'
+    strip: true
+    to: strip@example.com
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	labels := []string{}
+	for _, m := range cfg.fwdMappings {
+		labels = append(labels, m.label())
+	}
+
+	expected := "@ml|any(#incident, /(?i)outage/)|all(@board, any(#vote, #poll))|/(?i)outage/"
+	if strings.Join(labels, "|") != expected {
+		t.Errorf("unexpected rules: %s", strings.Join(labels, "|"))
+	}
+
+	// a plain marker rule needs no matcher
+	if cfg.fwdMappings[0].marker != "ml" || cfg.fwdMappings[0].opts.matcher != nil {
+		t.Errorf("unexpected marker rule: %+v", cfg.fwdMappings[0])
+	}
+
+	if m := cfg.fwdMappings[3].opts.matcher.(*regexMatcher); !m.strip {
+		t.Errorf("the regex should be stripped")
+	}
+}
+
+// content based rules should forward messages without a marker
+func TestDispatchWithContentRules(t *testing.T) {
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	outage, _ := newRegexMatcher("(?i)outage")
+	go dispatch(context.Background(), chatMock, mailMock, testConfig(
+		fwdMapping{marker: "ml", mailAddr: "ml@mail.com"},
+		fwdMapping{mailAddr: "oncall@mail.com", opts: &fwdOptions{matcher: anyMatcher{&hashtagMatcher{hashtag: "incident"}, outage}}},
+	))
+
+	chatMock.TriggerMsgEvent(chat.Message{UserName: "user", ChannelName: "channel", Content: "db down #incident"})
+	chatMock.TriggerMsgEvent(chat.Message{UserName: "user", ChannelName: "channel", Content: "@ml planned OUTAGE at 4"})
+	chatMock.TriggerMsgEvent(chat.Message{UserName: "user", ChannelName: "channel", Content: "all fine"})
+
+	found := []string{}
+	for _, m := range mailMock.Messages() {
+		found = append(found, m.Header.To.String()+":"+m.Content)
+	}
+
+	expected := "oncall@mail.com:db down #incident|ml@mail.com:planned OUTAGE at 4|oncall@mail.com:@ml planned OUTAGE at 4"
+	if strings.Join(found, "|") != expected {
+		t.Errorf("unexpected mails: %q", found)
+	}
+}
@@ -0,0 +1,226 @@
+// Package outbox implements a persistent queue for mail messages which
+// couldn't be delivered.
+//
+// each entry is saved as a json file in a spool directory, so the queue
+// survives a restart:
+//
+//   * <dir>/queue: entries which are retried with exponential backoff
+//   * <dir>/dead:  entries which are given up after the max. number of attempts
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/section77/matterbot/logger"
+	"github.com/section77/matterbot/mail"
+)
+
+// maxDelay caps the exponential backoff between two attempts
+const maxDelay = 1 * time.Hour
+
+// Entry represents a queued mail message
+type Entry struct {
+	ID   string
+	Mail *mail.Message
+
+	// chat thread of the original message - to notify the user if the mail is given up
+	ReplyToID   string
+	ChannelID   string
+	ChannelName string
+
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+// Outbox is the persistent mail queue
+type Outbox struct {
+	queueDir    string
+	deadDir     string
+	maxAttempts int
+	retryDelay  time.Duration
+
+	// to prevent concurrent file access
+	mutex sync.Mutex
+}
+
+// New opens the outbox in the given directory - missing directories are created.
+//
+//   * 'maxAttempts' is the number of attempts before an entry is given up
+//   * 'retryDelay' is the delay after the first attempt - it doubles after each attempt
+func New(dir string, maxAttempts int, retryDelay time.Duration) (*Outbox, error) {
+	o := &Outbox{
+		queueDir:    filepath.Join(dir, "queue"),
+		deadDir:     filepath.Join(dir, "dead"),
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+	}
+
+	for _, d := range []string{o.queueDir, o.deadDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, fmt.Errorf("unable to create outbox directory: %s", err.Error())
+		}
+	}
+	return o, nil
+}
+
+// Add queues the given entry after a failed first attempt.
+//
+// returns 'true' if the max. number of attempts are already reached and
+// the entry was moved to the dead-letter store.
+func (o *Outbox) Add(e *Entry, err error) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	return o.fail(e, err)
+}
+
+// Due returns all queued entries which should be retried at the given time
+func (o *Outbox) Due(now time.Time) ([]*Entry, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entries, err := readEntries(o.queueDir)
+	if err != nil {
+		return nil, err
+	}
+
+	due := []*Entry{}
+	for _, e := range entries {
+		if !e.NextAttempt.After(now) {
+			due = append(due, e)
+		}
+	}
+	return due, nil
+}
+
+// Dead returns all given up entries
+func (o *Outbox) Dead() ([]*Entry, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return readEntries(o.deadDir)
+}
+
+// Delivered removes the given entry from the queue
+func (o *Outbox) Delivered(e *Entry) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	logger.Debugf("outbox entry: %s delivered after %d attempts", e.ID, e.Attempts+1)
+	return os.Remove(filepath.Join(o.queueDir, e.ID+".json"))
+}
+
+// Failed records a failed attempt for the given entry.
+//
+// returns 'true' if the max. number of attempts are reached and
+// the entry was moved to the dead-letter store.
+func (o *Outbox) Failed(e *Entry, err error) (bool, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.fail(e, err)
+}
+
+// fail increments the attempts and schedules the next attempt, or
+// moves the entry to the dead-letter store
+func (o *Outbox) fail(e *Entry, err error) (bool, error) {
+	e.Attempts = e.Attempts + 1
+	e.LastError = err.Error()
+
+	if e.Attempts >= o.maxAttempts {
+		logger.Infof("outbox entry: %s to %s given up after %d attempts", e.ID, e.Mail.Header.To, e.Attempts)
+		if err := writeEntry(o.deadDir, e); err != nil {
+			return true, err
+		}
+
+		if err := os.Remove(filepath.Join(o.queueDir, e.ID+".json")); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+		return true, nil
+	}
+
+	e.NextAttempt = time.Now().Add(o.backoff(e.Attempts))
+	logger.Debugf("outbox entry: %s failed %d times - next attempt at: %s",
+		e.ID, e.Attempts, e.NextAttempt.Format(time.RFC3339))
+	return false, writeEntry(o.queueDir, e)
+}
+
+// backoff returns the delay after the given number of attempts
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.retryDelay
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay = delay * 2
+	}
+
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// writeEntry saves the entry atomically - a crash never leaves a partial file
+func writeEntry(dir string, e *Entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := filepath.Join(dir, "."+e.ID+".tmp")
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filepath.Join(dir, e.ID+".json"))
+}
+
+// readEntries returns all entries in the given directory - ordered by their id
+func readEntries(dir string) ([]*Entry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*Entry{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var e Entry
+		if err := json.Unmarshal(buf, &e); err != nil {
+			logger.Errorf("ignore invalid outbox entry: %s - error: %s", f.Name(), err.Error())
+			continue
+		}
+		entries = append(entries, &e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// newID returns a unique id, which sorts in the order of creation
+func newID() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(buf))
+}
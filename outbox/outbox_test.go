@@ -0,0 +1,112 @@
+package outbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/section77/matterbot/mail"
+)
+
+func newTestOutbox(t *testing.T, maxAttempts int) (*Outbox, string) {
+	dir, err := ioutil.TempDir("", "matterbot-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := New(dir, maxAttempts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, dir
+}
+
+// queued entries should survive a restart and are removed after the delivery
+func TestOutboxPersistsEntries(t *testing.T) {
+	o, dir := newTestOutbox(t, 3)
+	defer os.RemoveAll(dir)
+
+	if _, err := o.Add(&Entry{
+		Mail:      &mail.Message{Header: mail.Header{To: mail.AddressList{{Address: "ml@mail.com"}}}, Content: "test"},
+		ReplyToID: "post-id",
+	}, errors.New("mail-error")); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen - emulates a restart
+	o, err := New(dir, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := o.Due(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one queued entry, found: %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.Mail.Header.To.String() != "ml@mail.com" || e.ReplyToID != "post-id" || e.Attempts != 1 || e.LastError != "mail-error" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	if err := o.Delivered(e); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := o.Due(time.Now()); len(entries) != 0 {
+		t.Errorf("expected an empty queue after the delivery, found: %d entries", len(entries))
+	}
+}
+
+// entries should move to the dead-letter store after the max. number of attempts
+func TestOutboxMovesEntriesToDeadLetterStore(t *testing.T) {
+	o, dir := newTestOutbox(t, 2)
+	defer os.RemoveAll(dir)
+
+	e := &Entry{Mail: &mail.Message{Header: mail.Header{To: mail.AddressList{{Address: "ml@mail.com"}}}}}
+	if dead, err := o.Add(e, errors.New("first")); dead || err != nil {
+		t.Fatalf("entry should be queued after the first attempt - dead: %t, error: %v", dead, err)
+	}
+
+	if dead, err := o.Failed(e, errors.New("second")); !dead || err != nil {
+		t.Fatalf("entry should be given up after the second attempt - dead: %t, error: %v", dead, err)
+	}
+
+	if entries, _ := o.Due(time.Now()); len(entries) != 0 {
+		t.Errorf("expected an empty queue, found: %d entries", len(entries))
+	}
+
+	dead, err := o.Dead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].LastError != "second" {
+		t.Errorf("unexpected dead-letter store content: %+v", dead)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := &Outbox{retryDelay: 30 * time.Second}
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, 1 * time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, maxDelay},
+		{100, maxDelay},
+	}
+
+	for _, test := range tests {
+		if delay := o.backoff(test.attempts); delay != test.expected {
+			t.Errorf("delay after %d attempts - expected: %s, received: %s", test.attempts, test.expected, delay)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/section77/matterbot/chat"
+)
+
+// permission restricts who can forward messages with a marker.
+//
+// the sender needs at least one of: a permitted user name, a membership in
+// a permitted group, or a permitted role - like 'system_admin', 'team_admin'
+// or 'channel_admin'.
+type permission struct {
+	users  []string
+	groups []string
+	roles  []string
+}
+
+// newPermission returns 'nil' if no restriction is given
+func newPermission(users, groups, roles []string) *permission {
+	if len(users)+len(groups)+len(roles) == 0 {
+		return nil
+	}
+	return &permission{users, groups, roles}
+}
+
+// allows returns 'true' if the sender is permitted - a 'nil' permission
+// allows everyone
+func (p *permission) allows(sender *chat.Sender) bool {
+	if p == nil {
+		return true
+	}
+	return contains(p.users, sender.UserName) ||
+		containsAny(p.groups, sender.Groups) ||
+		containsAny(p.roles, sender.Roles)
+}
+
+// String describes who is permitted - it's used in the reply to rejected messages
+func (p *permission) String() string {
+	xs := []string{}
+	if len(p.users) > 0 {
+		xs = append(xs, "users: "+strings.Join(p.users, ", "))
+	}
+	if len(p.groups) > 0 {
+		xs = append(xs, "groups: "+strings.Join(p.groups, ", "))
+	}
+	if len(p.roles) > 0 {
+		xs = append(xs, "roles: "+strings.Join(p.roles, ", "))
+	}
+	return strings.Join(xs, " - ")
+}
+
+// rejectReason returns the reply for a message from a sender which isn't permitted
+func (p *permission) rejectReason(rule string) string {
+	return fmt.Sprintf("matterbot: you are not allowed to forward messages with: '%s' - permitted are %s",
+		rule, p.String())
+}
+
+func contains(xs []string, s string) bool {
+	for _, x := range xs {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(xs []string, ys []string) bool {
+	for _, y := range ys {
+		if contains(xs, y) {
+			return true
+		}
+	}
+	return false
+}
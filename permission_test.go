@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/section77/matterbot/chat"
+)
+
+func TestPermissionAllows(t *testing.T) {
+	senders := newPermission([]string{"alice", "bob"}, nil, nil)
+	groups := newPermission(nil, []string{"board"}, nil)
+	roles := newPermission(nil, nil, []string{"system_admin", "team_admin", "channel_admin"})
+	mixed := newPermission([]string{"alice"}, []string{"board"}, []string{"channel_admin"})
+
+	tests := []struct {
+		name       string
+		permission *permission
+		sender     chat.Sender
+		allowed    bool
+	}{
+		{"nil permission", nil, chat.Sender{UserName: "mallory"}, true},
+		{"permitted sender", senders, chat.Sender{UserName: "bob"}, true},
+		{"not permitted sender", senders, chat.Sender{UserName: "mallory"}, false},
+		{"member of a permitted group", groups, chat.Sender{UserName: "carol", Groups: []string{"staff", "board"}}, true},
+		{"member of other groups", groups, chat.Sender{UserName: "carol", Groups: []string{"staff"}}, false},
+		{"system admin", roles, chat.Sender{UserName: "dave", Roles: []string{"system_user", "system_admin"}}, true},
+		{"team admin", roles, chat.Sender{UserName: "dave", Roles: []string{"team_user", "team_admin"}}, true},
+		{"channel admin", roles, chat.Sender{UserName: "dave", Roles: []string{"channel_user", "channel_admin"}}, true},
+		{"without a permitted role", roles, chat.Sender{UserName: "dave", Roles: []string{"system_user", "team_user"}}, false},
+		{"one of the permissions", mixed, chat.Sender{UserName: "erin", Roles: []string{"channel_admin"}}, true},
+		{"none of the permissions", mixed, chat.Sender{UserName: "erin", Groups: []string{"staff"}, Roles: []string{"team_admin"}}, false},
+	}
+
+	for _, test := range tests {
+		if allowed := test.permission.allows(&test.sender); allowed != test.allowed {
+			t.Errorf("%s: expected allowed: %t, received: %t", test.name, test.allowed, allowed)
+		}
+	}
+}
+
+func TestNewPermissionWithoutRestriction(t *testing.T) {
+	if p := newPermission(nil, []string{}, nil); p != nil {
+		t.Errorf("expected 'nil' without restriction, received: %+v", p)
+	}
+}
+
+func TestPermissionRejectReason(t *testing.T) {
+	tests := []struct {
+		permission *permission
+		expected   string
+	}{
+		{
+			newPermission([]string{"alice", "bob"}, nil, nil),
+			"matterbot: you are not allowed to forward messages with: '@ml' - permitted are users: alice, bob",
+		},
+		{
+			newPermission(nil, []string{"board"}, []string{"team_admin"}),
+			"matterbot: you are not allowed to forward messages with: '@ml' - permitted are groups: board - roles: team_admin",
+		},
+		{
+			newPermission([]string{"alice"}, []string{"board"}, []string{"system_admin", "channel_admin"}),
+			"matterbot: you are not allowed to forward messages with: '@ml' - permitted are users: alice - groups: board - roles: system_admin, channel_admin",
+		},
+	}
+
+	for _, test := range tests {
+		if reason := test.permission.rejectReason("@ml"); reason != test.expected {
+			t.Errorf("expected reason: '%s', received: '%s'", test.expected, reason)
+		}
+	}
+}
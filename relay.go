@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/logger"
+	"github.com/section77/matterbot/mail"
+)
+
+// replyRelay posts the replies to forwarded mails in the thread of the
+// original message - the replies are received per 'mail.Receiver'.
+//
+// the original message is found per:
+//   - the signed tag of the recipient address - see '-mail-reply-to'
+//   - the 'In-Reply-To' / 'References' header - the message ids of the
+//     forwarded mails are derived from the post id (see 'threadHeader')
+//
+// only messages which are remembered as forwarded (see '-dedup-file') are
+// accepted - so nobody can post in other threads of the chat.
+type replyRelay struct {
+	sync.Mutex
+
+	// 'nil' while disconnected
+	chatServer chat.Server
+}
+
+// connected sets the chat server for the replies - 'nil' if disconnected
+func (r *replyRelay) connected(chatServer chat.Server) {
+	r.Lock()
+	defer r.Unlock()
+	r.chatServer = chatServer
+}
+
+// handle posts the reply without the quoted text in the thread of the original message
+func (r *replyRelay) handle(in *mail.Incoming) error {
+	r.Lock()
+	chatServer := r.chatServer
+	r.Unlock()
+
+	if chatServer == nil {
+		return fmt.Errorf("not connected to the chat-server - %w", mail.ErrTryLater)
+	}
+
+	var original *chat.Message
+	for _, id := range replyPostIDs(in) {
+		if forwarded == nil || !forwarded.SeenAny(id) {
+			logger.Debugf("no forwarded message for reply to: %s", id)
+			continue
+		}
+		msg, err := chatServer.Message(id)
+		if err != nil {
+			logger.Debugf("no message for reply to: %s - %s", id, err.Error())
+			continue
+		}
+		original = msg
+		break
+	}
+	if original == nil {
+		return errors.New("no forwarded message found for the reply")
+	}
+
+	text := stripQuotes(in.Text)
+	if text == "" {
+		return errors.New("reply without text")
+	}
+
+	logger.Infof("relay reply from: %s in channel: %s", in.From, original.ChannelName)
+	err := chatServer.Send(&chat.Message{
+		ChannelID:   original.ChannelID,
+		ChannelName: original.ChannelName,
+		ReplyToID:   threadRootID(original),
+		Content:     fmt.Sprintf("**%s** replied per mail:\n\n%s", in.Sender(), text),
+	})
+	if err != nil {
+		return fmt.Errorf("%s - %w", err.Error(), mail.ErrTryLater)
+	}
+	return nil
+}
+
+// replyPostIDs returns the candidates for the post id of the original message - the
+// recipient tags with a valid signature first, then the ids from the thread header
+// (the nearest first)
+func replyPostIDs(in *mail.Incoming) []string {
+	ids := []string{}
+
+	if local, domain, ok := splitAddress(*mailReplyTo); ok {
+		prefix := strings.ToLower(local) + "+"
+		for _, to := range in.To {
+			l, d, ok := splitAddress(to)
+			if !ok || !strings.EqualFold(d, domain) || !strings.HasPrefix(strings.ToLower(l), prefix) {
+				continue
+			}
+			// tag: '<post-id>.<signature>'
+			tag := l[len(prefix):]
+			i := strings.LastIndexByte(tag, '.')
+			if i < 0 || !hmac.Equal([]byte(strings.ToLower(tag[i+1:])), []byte(replyTagSignature(tag[:i]))) {
+				logger.Infof("ignore recipient: %s - invalid signature", to)
+				continue
+			}
+			ids = append(ids, tag[:i])
+		}
+	}
+
+	for _, id := range in.ThreadIDs() {
+		l, d, ok := splitAddress(strings.Trim(id, "<>"))
+		if !ok || d != messageIDDomain() {
+			continue
+		}
+		// corrections and retractions: '<post-id>.correction.<edit-timestamp>' / '<post-id>.retraction'
+		if i := strings.IndexByte(l, '.'); i >= 0 {
+			l = l[:i]
+		}
+		ids = append(ids, l)
+	}
+	return ids
+}
+
+// replyToAddress returns the 'Reply-To' address for the given post - like
+// 'matterbot+<post-id>.<signature>@example.com'. it's empty if '-mail-reply-to'
+// isn't set.
+func replyToAddress(postID string) string {
+	local, domain, ok := splitAddress(*mailReplyTo)
+	if !ok {
+		return ""
+	}
+	return local + "+" + postID + "." + replyTagSignature(postID) + "@" + domain
+}
+
+// replyTagSignature returns the hmac of the post id per '-mail-reply-secret' - so
+// the tag of the 'Reply-To' address can't be forged for other posts
+func replyTagSignature(postID string) string {
+	mac := hmac.New(sha256.New, []byte(*mailReplySecret))
+	mac.Write([]byte(postID))
+	// shortened - the local part of a mail address is limited to 64 characters
+	return hex.EncodeToString(mac.Sum(nil)[:10])
+}
+
+// splitAddress splits the mail address in the local part and the domain
+func splitAddress(addr string) (string, string, bool) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i+1 >= len(addr) {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
+
+// attribution line before the quoted text - like 'On Mon, ... Alice wrote:' or 'Am ... schrieb Alice:'
+var attributionRegexp = regexp.MustCompile(`^(On|Am) .*(wrote|schrieb)[^:]*:$`)
+
+// stripQuotes removes the quoted text from a mail reply:
+//
+//   - lines with the '>' prefix, and the attribution line before them
+//   - everything after the signature separator ('-- ') or an 'Original Message' line
+func stripQuotes(text string) string {
+	lines := []string{}
+	inQuote := false
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || line == "--" || (strings.HasPrefix(trimmed, "-----") && strings.Contains(trimmed, "Original Message")) {
+			break
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			if !inQuote {
+				lines = dropAttribution(lines)
+			}
+			inQuote = true
+			continue
+		}
+		inQuote = false
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// dropAttribution removes the attribution line at the end of the lines - the
+// attribution can be wrapped in two lines
+func dropAttribution(lines []string) []string {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+
+	for n := 1; n <= 2 && n <= end; n++ {
+		attribution := strings.TrimSpace(strings.Join(lines[end-n:end], " "))
+		if attributionRegexp.MatchString(attribution) {
+			return lines[:end-n]
+		}
+	}
+	return lines
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/dedup"
+	"github.com/section77/matterbot/mail"
+)
+
+// replies should be posted in the thread of the original message - found per
+// thread header or per tagged recipient address
+func TestRelayPostsReplies(t *testing.T) {
+	origReplyTo, origReplySecret := *mailReplyTo, *mailReplySecret
+	defer func() { *mailReplyTo, *mailReplySecret = origReplyTo, origReplySecret }()
+	*mailReplyTo, *mailReplySecret = "bot@localhost", "secret"
+
+	dir := rememberForwardedForTest(t, "root", "reply")
+	defer func() {
+		forwarded = nil
+		os.RemoveAll(dir)
+	}()
+
+	chatMock := chat.NewMock()
+	chatMock.Posts = map[string]chat.Message{
+		"root":  chat.Message{ID: "root", ChannelID: "channel-id", ChannelName: "town-square"},
+		"reply": chat.Message{ID: "reply", RootID: "root", ChannelID: "channel-id", ChannelName: "town-square"},
+	}
+
+	relay := &replyRelay{}
+	relay.connected(chatMock)
+
+	// local smtp stand-in for the mail-server which delivers the replies
+	receiver := mail.NewReceiver("127.0.0.1:0", relay.handle)
+	if err := receiver.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go receiver.Serve(ctx)
+
+	tests := []struct {
+		to     string
+		header string
+	}{
+		{"ml@example.com", "In-Reply-To: <root@localhost>\r\n"},
+		{"ml@example.com", "References: <root@localhost> <reply.correction.123@localhost>\r\n"},
+		{replyToAddress("reply"), ""},
+	}
+	for _, test := range tests {
+		msg := "From: Alice <alice@example.com>\r\n" +
+			"Subject: Re: meeting\r\n" +
+			test.header +
+			"\r\n" +
+			"I'll be there.\r\n" +
+			"\r\n" +
+			"On Sat, 17 Oct 2026 at 12:00, matterbot <bot@localhost>\r\n" +
+			"wrote:\r\n" +
+			"> meeting at 4\r\n"
+		if err := smtp.SendMail(receiver.Addr().String(), nil, "alice@example.com", []string{test.to}, []byte(msg)); err != nil {
+			t.Errorf("reply to: %s with: %q - error: %s", test.to, test.header, err.Error())
+		}
+	}
+
+	if len(chatMock.Messages()) != len(tests) {
+		t.Fatalf("expected %d replies - found: %d", len(tests), len(chatMock.Messages()))
+	}
+	for _, msg := range chatMock.Messages() {
+		if msg.ChannelID != "channel-id" || msg.ReplyToID != "root" || msg.Content != "**Alice** replied per mail:\n\nI'll be there." {
+			t.Errorf("unexpected reply: %+v", msg)
+		}
+	}
+}
+
+// replies to unknown messages should be rejected - and deferred while disconnected
+func TestRelayRejectsReplies(t *testing.T) {
+	relay := &replyRelay{}
+
+	in, err := mail.ParseIncoming("alice@example.com", []string{"ml@example.com"},
+		[]byte("In-Reply-To: <root@localhost>\r\n\r\ntext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := relay.handle(in); err == nil || !strings.Contains(err.Error(), mail.ErrTryLater.Error()) {
+		t.Errorf("expected a temporary error while disconnected - found: %v", err)
+	}
+
+	relay.connected(chat.NewMock())
+	if err := relay.handle(in); err == nil || strings.Contains(err.Error(), mail.ErrTryLater.Error()) {
+		t.Errorf("expected a permanent error for an unknown message - found: %v", err)
+	}
+}
+
+// replies to existing, but never forwarded messages should be rejected - and
+// tags with an invalid signature should be ignored
+func TestRelayRejectsRepliesToNotForwardedMessages(t *testing.T) {
+	origReplyTo, origReplySecret := *mailReplyTo, *mailReplySecret
+	defer func() { *mailReplyTo, *mailReplySecret = origReplyTo, origReplySecret }()
+	*mailReplyTo, *mailReplySecret = "bot@localhost", "secret"
+
+	chatMock := chat.NewMock()
+	chatMock.Posts = map[string]chat.Message{
+		"forwarded": chat.Message{ID: "forwarded", ChannelID: "channel-id"},
+		"private":   chat.Message{ID: "private", ChannelID: "private-channel-id"},
+	}
+	relay := &replyRelay{}
+	relay.connected(chatMock)
+
+	tests := []struct {
+		name   string
+		to     string
+		header string
+	}{
+		{"thread header", "ml@example.com", "In-Reply-To: <private@localhost>\r\n"},
+		{"signed tag", replyToAddress("private"), ""},
+		{"forged tag", "bot+forwarded.0123456789abcdef0123@localhost", ""},
+		{"tag without signature", "bot+forwarded@localhost", ""},
+	}
+
+	// without the dedup store, no message is known as forwarded
+	forwarded = nil
+	in, _ := mail.ParseIncoming("mallory@example.com", []string{replyToAddress("forwarded")}, []byte("\r\ntext"))
+	if err := relay.handle(in); err == nil {
+		t.Errorf("without dedup store: expected an error - the reply was posted")
+	}
+
+	dir := rememberForwardedForTest(t, "forwarded")
+	defer func() {
+		forwarded = nil
+		os.RemoveAll(dir)
+	}()
+
+	for _, test := range tests {
+		in, err := mail.ParseIncoming("mallory@example.com", []string{test.to}, []byte(test.header+"\r\ntext"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := relay.handle(in); err == nil || strings.Contains(err.Error(), mail.ErrTryLater.Error()) {
+			t.Errorf("%s: expected a permanent error - found: %v", test.name, err)
+		}
+	}
+
+	if len(chatMock.Messages()) != 0 {
+		t.Errorf("expected no posted replies - found: %+v", chatMock.Messages())
+	}
+}
+
+// rememberForwardedForTest opens a dedup store in a temp directory, which
+// contains the given messages as forwarded - returns the directory
+func rememberForwardedForTest(t *testing.T, msgIDs ...string) string {
+	dir, err := ioutil.TempDir("", "matterbot-relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forwarded, err = dedup.New(filepath.Join(dir, "dedup.json"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range msgIDs {
+		rememberForwarded(id, "ml@example.com")
+	}
+	return dir
+}
+
+func TestStripQuotes(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"answer", "answer"},
+		{"answer\n\nOn Mon, 1 Jan 2026, Bob wrote:\n> question\n> more", "answer"},
+		{"answer\n\nAm 01.01.2026 um 12:00 schrieb Bob:\n> Frage", "answer"},
+		{"> question 1\nanswer 1\n> question 2\nanswer 2", "answer 1\nanswer 2"},
+		{"answer\n-- \nBob\nsignature", "answer"},
+		{"answer\n\n-----Original Message-----\nFrom: Bob", "answer"},
+		{"On time, we wrote: the plan", "On time, we wrote: the plan"},
+	}
+
+	for _, test := range tests {
+		if text := stripQuotes(test.text); text != test.expected {
+			t.Errorf("text: %q\n\texpected: %q\n\tfound:    %q", test.text, test.expected, text)
+		}
+	}
+}
+
+func TestReplyToAddress(t *testing.T) {
+	origReplyTo, origReplySecret := *mailReplyTo, *mailReplySecret
+	defer func() { *mailReplyTo, *mailReplySecret = origReplyTo, origReplySecret }()
+	*mailReplySecret = "secret"
+
+	*mailReplyTo = ""
+	if addr := replyToAddress("post-1"); addr != "" {
+		t.Errorf("expected no address - found: %s", addr)
+	}
+
+	*mailReplyTo = "bot@example.com"
+	addr := replyToAddress("post-1")
+	if !strings.HasPrefix(addr, "bot+post-1.") || !strings.HasSuffix(addr, "@example.com") || len(addr) != len("bot+post-1.@example.com")+20 {
+		t.Errorf("unexpected address: %s", addr)
+	}
+
+	// the tag should be accepted only with the signature of the same secret
+	in := &mail.Incoming{To: []string{addr}}
+	if ids := replyPostIDs(in); len(ids) != 1 || ids[0] != "post-1" {
+		t.Errorf("expected the post id from the signed tag - found: %v", ids)
+	}
+	*mailReplySecret = "other-secret"
+	if ids := replyPostIDs(in); len(ids) != 0 {
+		t.Errorf("expected no post id with another secret - found: %v", ids)
+	}
+}
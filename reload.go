@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/section77/matterbot/logger"
+)
+
+// interval to check the config file for changes
+var configPollInterval = 5 * time.Second
+
+// liveConfig holds the active forward config, which can be swapped at runtime
+// without interrupting the 'dispatch' loop
+type liveConfig struct {
+	value atomic.Value
+}
+
+func newLiveConfig(fc *forwardConfig) *liveConfig {
+	lc := &liveConfig{}
+	lc.store(fc)
+	return lc
+}
+
+func (lc *liveConfig) load() *forwardConfig {
+	return lc.value.Load().(*forwardConfig)
+}
+
+func (lc *liveConfig) store(fc *forwardConfig) {
+	lc.value.Store(fc)
+}
+
+// watchReload reloads the forward config if the process receives
+// a SIGHUP signal, or the config file changes
+func watchReload(lc *liveConfig) {
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
+
+	var pollC <-chan time.Time
+	var lastModTime time.Time
+	if len(*configFile) > 0 {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		pollC = ticker.C
+		lastModTime = modTime(*configFile)
+	}
+
+	for {
+		select {
+		case <-hupC:
+			logger.Info("SIGHUP received - reload config")
+			reload(lc)
+		case <-pollC:
+			if t := modTime(*configFile); t.After(lastModTime) {
+				lastModTime = t
+				logger.Info("config file changed - reload config")
+				reload(lc)
+			}
+		}
+	}
+}
+
+// reload parses and validates the config and swaps the forward config.
+// if the config is invalid, the old config stays in use.
+func reload(lc *liveConfig) error {
+	var cfg *config
+	if len(*configFile) > 0 {
+		var err error
+		if cfg, err = readConfig(*configFile); err != nil {
+			logger.Errorf("invalid config - keep the old config - error: %s", err.Error())
+			return err
+		}
+	}
+
+	fc, err := newForwardConfig(cfg)
+	if err != nil {
+		logger.Errorf("invalid config - keep the old config - error: %s", err.Error())
+		return err
+	}
+
+	lc.store(fc)
+	logger.Infof("config reloaded - %d forward mappings active", len(fc.fwdMappings))
+	return nil
+}
+
+// modTime returns the modification time of the given file - zero time on errors
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
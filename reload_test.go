@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/mail"
+)
+
+// a reload should swap the forward config without interrupting 'dispatch',
+// and an invalid config should keep the old config in use
+func TestReloadSwapsConfigInRunningDispatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origConfigFile := *configFile
+	*configFile = filepath.Join(dir, "config.yml")
+	defer func() {
+		*configFile = origConfigFile
+	}()
+
+	chatMock := chat.NewMock()
+	mailMock := mail.NewMock()
+
+	lc := testConfig(fwdMapping{marker: "old", mailAddr: "old@mail.com"})
+	go dispatch(context.Background(), chatMock, mailMock, lc)
+
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(*configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("mail-subject: new subject\nforward:\n  - marker: new\n    to: new@mail.com\n")
+	if err := reload(lc); err != nil {
+		t.Fatalf("unexpected reload error: %s", err.Error())
+	}
+
+	chatMock.TriggerMsgEvent(chat.Message{Content: "@old hey"})
+	chatMock.TriggerMsgEvent(chat.Message{Content: "@new hey"})
+	verifyDispatchSendsMailToAllRecipients("reloaded config", mailMock.Messages(), []string{"new@mail.com"}, t)
+	if len(mailMock.Messages()) == 1 && mailMock.Messages()[0].Header.Subject != "new subject" {
+		t.Errorf("reloaded subject template not used - subject: %s", mailMock.Messages()[0].Header.Subject)
+	}
+	mailMock.ClearMessages()
+
+	writeConfig("forward:\n  - marker: invalid\n")
+	if err := reload(lc); err == nil {
+		t.Fatalf("invalid config should not be reloaded")
+	}
+
+	chatMock.TriggerMsgEvent(chat.Message{Content: "@new hey"})
+	verifyDispatchSendsMailToAllRecipients("invalid config", mailMock.Messages(), []string{"new@mail.com"}, t)
+}
+
+// a setting which is removed from the config file should fall back to the
+// value from the command line or the flag default
+func TestReloadWithRemovedSetting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origConfigFile, origMarkerMode := *configFile, *markerMode
+	*configFile = filepath.Join(dir, "config.yml")
+	defer func() {
+		*configFile, *markerMode = origConfigFile, origMarkerMode
+		flagDefaults = map[string]string{}
+	}()
+
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(*configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// like on startup
+	writeConfig("marker-mode: anywhere\nforward: ml=ml@mail.com\n")
+	saveFlagDefaults()
+	cfg, err := readConfig(*configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply(); err != nil {
+		t.Fatal(err)
+	}
+	fc, err := newForwardConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.markerMode != markerModeAnywhere {
+		t.Fatalf("expected marker-mode: %s from the config file, found: %s", markerModeAnywhere, fc.markerMode)
+	}
+	lc := newLiveConfig(fc)
+
+	writeConfig("forward: ml=ml@mail.com\n")
+	if err := reload(lc); err != nil {
+		t.Fatalf("unexpected reload error: %s", err.Error())
+	}
+	if mode := lc.load().markerMode; mode != origMarkerMode {
+		t.Errorf("expected the default marker-mode: %s after the reload, found: %s", origMarkerMode, mode)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/section77/matterbot/chat"
+	"github.com/section77/matterbot/logger"
+)
+
+// scope restricts the teams and channels where messages are forwarded.
+//
+//   - teams are given per name, channels per '<team-name>/<channel-name>'
+//   - a message from a denied team or channel is never forwarded
+//   - if any allow-list is set, only messages from the allowed teams
+//     or channels are forwarded (direct messages are not in any team)
+type scope struct {
+	allowTeams    []string
+	denyTeams     []string
+	allowChannels []string
+	denyChannels  []string
+}
+
+// newScope validates the given lists - an empty scope returns 'nil'
+func newScope(allowTeams, denyTeams, allowChannels, denyChannels []string) (*scope, error) {
+	for _, c := range append(append([]string{}, allowChannels...), denyChannels...) {
+		if x := strings.Split(c, "/"); len(x) != 2 || x[0] == "" || x[1] == "" {
+			return nil, fmt.Errorf("invalid channel: '%s' - valid example: 'team/channel'", c)
+		}
+	}
+
+	if len(allowTeams)+len(denyTeams)+len(allowChannels)+len(denyChannels) == 0 {
+		return nil, nil
+	}
+	return &scope{allowTeams, denyTeams, allowChannels, denyChannels}, nil
+}
+
+// splitList splits a comma separated list - an empty string returns an empty list
+func splitList(s string) []string {
+	xs := []string{}
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+// scopeIDs contains the resolved ids of a scope
+type scopeIDs struct {
+	// 'true' if the scope has any allow-list - even if the ids can't be resolved
+	restricted bool
+
+	// 'true' if a name in a deny-list can't be resolved - no message is allowed
+	denyAll bool
+
+	allowTeams    map[string]bool
+	denyTeams     map[string]bool
+	allowChannels map[string]bool
+	denyChannels  map[string]bool
+}
+
+// resolve the team and channel names to their ids.
+//
+// names which can't be resolved are logged and ignored - an unresolved
+// name in an allow-list never matches. an unresolved name in a deny-list
+// returns an error and the scope denies all messages.
+func (s *scope) resolve(resolver chat.Resolver) (*scopeIDs, error) {
+	ids := &scopeIDs{
+		restricted:    len(s.allowTeams)+len(s.allowChannels) > 0,
+		allowTeams:    map[string]bool{},
+		denyTeams:     map[string]bool{},
+		allowChannels: map[string]bool{},
+		denyChannels:  map[string]bool{},
+	}
+
+	resolveTeams(resolver, s.allowTeams, ids.allowTeams)
+	resolveChannels(resolver, s.allowChannels, ids.allowChannels)
+
+	unresolved := append(resolveTeams(resolver, s.denyTeams, ids.denyTeams),
+		resolveChannels(resolver, s.denyChannels, ids.denyChannels)...)
+	if len(unresolved) > 0 {
+		ids.denyAll = true
+		return ids, fmt.Errorf("unable to resolve the denied teams / channels: '%s' - no message is forwarded",
+			strings.Join(unresolved, "', '"))
+	}
+	return ids, nil
+}
+
+// allows returns 'true' if the message is allowed in this scope
+func (ids *scopeIDs) allows(msg *chat.Message) bool {
+	if ids.denyAll || ids.denyTeams[msg.TeamID] || ids.denyChannels[msg.ChannelID] {
+		return false
+	}
+
+	if ids.restricted {
+		return ids.allowTeams[msg.TeamID] || ids.allowChannels[msg.ChannelID]
+	}
+	return true
+}
+
+// resolveTeams adds the ids of the given teams - the unresolved names are returned
+func resolveTeams(resolver chat.Resolver, names []string, ids map[string]bool) []string {
+	unresolved := []string{}
+	for _, name := range names {
+		id, err := resolver.TeamID(name)
+		if err != nil {
+			logger.Errorf("unable to resolve team: '%s' - error: %s", name, err.Error())
+			unresolved = append(unresolved, name)
+			continue
+		}
+		ids[id] = true
+	}
+	return unresolved
+}
+
+// resolveChannels adds the ids of the given channels - the unresolved names are returned
+func resolveChannels(resolver chat.Resolver, names []string, ids map[string]bool) []string {
+	unresolved := []string{}
+	for _, name := range names {
+		x := strings.Split(name, "/")
+		id, err := resolver.ChannelID(x[0], x[1])
+		if err != nil {
+			logger.Errorf("unable to resolve channel: '%s' - error: %s", name, err.Error())
+			unresolved = append(unresolved, name)
+			continue
+		}
+		ids[id] = true
+	}
+	return unresolved
+}
+
+// resolvedScopes contains the resolved ids of all scopes in a forward config
+type resolvedScopes struct {
+	fc     *forwardConfig
+	global *scopeIDs
+	marker map[*scope]*scopeIDs
+}
+
+// resolveScopes resolves the global scope and the scopes of all forward rules.
+//
+// the scopes are usable even if an error is returned - a scope with an
+// unresolved deny-list denies all messages.
+func resolveScopes(resolver chat.Resolver, fc *forwardConfig) (*resolvedScopes, error) {
+	rs := &resolvedScopes{
+		fc:     fc,
+		marker: map[*scope]*scopeIDs{},
+	}
+
+	var firstErr error
+	if fc.scope != nil {
+		rs.global, firstErr = fc.scope.resolve(resolver)
+	}
+
+	for _, m := range fc.fwdMappings {
+		if m.opts != nil && m.opts.scope != nil && rs.marker[m.opts.scope] == nil {
+			ids, err := m.opts.scope.resolve(resolver)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("rule: '%s': %s", m.label(), err.Error())
+			}
+			rs.marker[m.opts.scope] = ids
+		}
+	}
+	return rs, firstErr
+}
+
+// allows returns 'true' if the message can be forwarded with the given mapping
+func (rs *resolvedScopes) allows(msg *chat.Message, m fwdMapping) bool {
+	if rs.global != nil && !rs.global.allows(msg) {
+		return false
+	}
+
+	if m.opts != nil && m.opts.scope != nil {
+		return rs.marker[m.opts.scope].allows(msg)
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/section77/matterbot/chat"
+)
+
+func TestScopeAllows(t *testing.T) {
+	chatMock := chat.NewMock()
+	chatMock.TeamIDs = map[string]string{"team": "team-id", "other": "other-id"}
+	chatMock.ChannelIDs = map[string]string{"team/announcements": "ann-id", "team/off-topic": "off-id"}
+
+	global, _ := newScope(nil, []string{"other"}, nil, []string{"team/off-topic"})
+	ml, _ := newScope(nil, nil, []string{"team/announcements", "team/missing"}, nil)
+	unresolved, _ := newScope([]string{"missing"}, nil, nil, nil)
+
+	fc := &forwardConfig{
+		scope: global,
+		fwdMappings: []fwdMapping{
+			fwdMapping{marker: "ml", mailAddr: "ml@mail.com", opts: &fwdOptions{scope: ml}},
+			fwdMapping{marker: "all", mailAddr: "all@mail.com"},
+			fwdMapping{marker: "none", mailAddr: "none@mail.com", opts: &fwdOptions{scope: unresolved}},
+		},
+	}
+	scopes, err := resolveScopes(chatMock, fc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	tests := []struct {
+		name    string
+		msg     chat.Message
+		mapping int
+		allowed bool
+	}{
+		{"allowed channel", chat.Message{TeamID: "team-id", ChannelID: "ann-id"}, 0, true},
+		{"not allowed channel", chat.Message{TeamID: "team-id", ChannelID: "town-square-id"}, 0, false},
+		{"direct message", chat.Message{ChannelID: "dm-id"}, 0, false},
+		{"unrestricted marker", chat.Message{TeamID: "team-id", ChannelID: "town-square-id"}, 1, true},
+		{"unrestricted marker in direct message", chat.Message{ChannelID: "dm-id"}, 1, true},
+		{"globally denied team", chat.Message{TeamID: "other-id", ChannelID: "x-id"}, 1, false},
+		{"globally denied channel", chat.Message{TeamID: "team-id", ChannelID: "off-id"}, 1, false},
+		{"unresolved allow-list", chat.Message{TeamID: "team-id", ChannelID: "ann-id"}, 2, false},
+	}
+
+	for _, test := range tests {
+		if allowed := scopes.allows(&test.msg, fc.fwdMappings[test.mapping]); allowed != test.allowed {
+			t.Errorf("%s: expected allowed: %t, received: %t", test.name, test.allowed, allowed)
+		}
+	}
+}
+
+// an unresolved name in a deny-list should return an error, and the
+// scope should deny all messages
+func TestScopeWithUnresolvedDenyList(t *testing.T) {
+	chatMock := chat.NewMock()
+	chatMock.TeamIDs = map[string]string{"team": "team-id"}
+
+	tests := []struct {
+		name  string
+		scope func() (*scope, error)
+	}{
+		{"denied team", func() (*scope, error) { return newScope(nil, []string{"team", "missing"}, nil, nil) }},
+		{"denied channel", func() (*scope, error) { return newScope(nil, nil, nil, []string{"team/missing"}) }},
+	}
+
+	for _, test := range tests {
+		s, _ := test.scope()
+		fc := &forwardConfig{
+			fwdMappings: []fwdMapping{
+				fwdMapping{marker: "ml", mailAddr: "ml@mail.com", opts: &fwdOptions{scope: s}},
+			},
+		}
+
+		scopes, err := resolveScopes(chatMock, fc)
+		if err == nil || !strings.Contains(err.Error(), "missing") {
+			t.Errorf("%s: expected an error with the unresolved name, received: %v", test.name, err)
+		}
+		if scopes.allows(&chat.Message{TeamID: "other-id", ChannelID: "other-channel-id"}, fc.fwdMappings[0]) {
+			t.Errorf("%s: the scope should deny all messages", test.name)
+		}
+	}
+}
+
+func TestNewScopeValidatesChannels(t *testing.T) {
+	if _, err := newScope(nil, nil, []string{"announcements"}, nil); err == nil {
+		t.Errorf("channel without team should be rejected")
+	}
+
+	if s, err := newScope(nil, nil, nil, nil); s != nil || err != nil {
+		t.Errorf("empty scope should be 'nil' - scope: %+v, error: %v", s, err)
+	}
+}